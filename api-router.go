@@ -5,14 +5,16 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -20,24 +22,49 @@ import (
 )
 
 var (
+	// defaultDialer is used by the default client, it has a 2 second timeout and 0 keep-alives
+	defaultDialer = &net.Dialer{
+		Timeout:   2000 * time.Millisecond,
+		KeepAlive: 0,
+	}
 	// defaultClient provides a network client with a the timeout set to 2seconds and 0 keep-alives
 	defaultClient = &http.Client{
 		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   2000 * time.Millisecond,
-				KeepAlive: 0,
-			}).DialContext,
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         defaultDialer.DialContext,
 			TLSHandshakeTimeout: 2000 * time.Millisecond,
 		},
 		Timeout: 2000 * time.Millisecond,
 	}
+	// sharedClientMu guards sharedClient
+	sharedClientMu sync.RWMutex
+	// sharedClient replaces defaultClient for routers constructed without a client when set with SetDefaultClient
+	sharedClient *http.Client
 )
 
+// SetDefaultClient sets the client used by routers constructed afterwards that are not given a client of their own
+// routers which already exist keep their client, passing nil restores the built in client
+// internal probe transport options, e.g WithNetworkPreference, only apply to the built in client
+func SetDefaultClient(client *http.Client) {
+	sharedClientMu.Lock()
+	defer sharedClientMu.Unlock()
+	sharedClient = client
+}
+
+// newRouterClient returns the client set with SetDefaultClient or the built in client when none is set
+func newRouterClient() *http.Client {
+	sharedClientMu.RLock()
+	defer sharedClientMu.RUnlock()
+	if sharedClient != nil {
+		return sharedClient
+	}
+	return defaultClient
+}
+
 var (
 	// ErrAtLeastOne at least one field of EndPoints needs to initialized
 	ErrAtLeastOne = errors.New("at least one endpoint has to be passed in")
-	// ErrBadStatus notifies the user that the status code is not a 200
+	// ErrBadStatus notifies the user that the status code is not a 2xx
 	ErrBadStatus = errors.New("received a non 200 status code")
 	// ErrFallbackUnset notifies that the fallback should be sent, even if it's a duplicative endpoint
 	ErrFallbackUnset = errors.New("a fallback endpoint should be sent as a safety mechanism")
@@ -49,42 +76,162 @@ var (
 	ErrConnectionReset = errors.New("the connection was reset by host")
 	// ErrNoSuchHost the host could not be found on the endpoint
 	ErrNoSuchHost = errors.New("the endpoint's host could not be found")
+	// ErrCertificateMismatch the endpoint presented a certificate that doesn't match the expected fingerprint
+	ErrCertificateMismatch = errors.New("the endpoint's certificate does not match the expected fingerprint")
+	// ErrDuplicateEndpoint two regions share the same endpoint, which makes latency routing between them meaningless
+	ErrDuplicateEndpoint = errors.New("the same endpoint is used by more than one region")
+	// ErrMalformedConfig the endpoints config could not be decoded
+	ErrMalformedConfig = errors.New("the endpoints config is malformed")
+	// ErrAllEndpointsFailed none of the endpoints responded during a latency check
+	ErrAllEndpointsFailed = errors.New("every endpoint failed the latency check")
+	// ErrInsufficientEndpointsForLatency latency routing was enabled with a single endpoint, so there is nothing to compare
+	ErrInsufficientEndpointsForLatency = errors.New("at least two endpoints are needed for latency routing")
+	// ErrInvalidWeight an endpoint weight is zero or negative
+	ErrInvalidWeight = errors.New("endpoint weights have to be positive")
+	// ErrInvalidAlpha the EWMA smoothing factor is not in (0, 1]
+	ErrInvalidAlpha = errors.New("the EWMA alpha has to be greater than 0 and at most 1")
+	// ErrClosestURLMismatch the preset fastest URL is not one of the configured regions
+	ErrClosestURLMismatch = errors.New("the fastest URL is not one of the configured regions")
 )
 
 // EndPoints belonging the the API service that is being used
 type EndPoints struct {
-	AsiaPacific string `json:"asia_pacific,omitempty"` // APAC
-	Europe      string `json:"europe,omitempty"`       // EU
-	Universal   string `json:"universal,omitempty"`    // Some APIs contain a single endpoint, which is latency load balanced by the DNS and load balancer
-	USEast      string `json:"us_east,omitempty"`      // us-east-1
-	USWest      string `json:"us_west,omitempty"`      // us-west-1
-	Fallback    string `json:"fallback,omitempty"`     // provides an optional endpoint to fallback to in emergencies
-	FastestURL  string `json:"fastest_url,omitempty"`  // is the fastest endpoint based on a head request
+	AsiaPacific string `json:"asia_pacific,omitempty" yaml:"asia_pacific,omitempty"` // APAC
+	Europe      string `json:"europe,omitempty" yaml:"europe,omitempty"`             // EU
+	Universal   string `json:"universal,omitempty" yaml:"universal,omitempty"`       // Some APIs contain a single endpoint, which is latency load balanced by the DNS and load balancer
+	USEast      string `json:"us_east,omitempty" yaml:"us_east,omitempty"`           // us-east-1
+	USWest      string `json:"us_west,omitempty" yaml:"us_west,omitempty"`           // us-west-1
+	Fallback    string `json:"fallback,omitempty" yaml:"fallback,omitempty"`         // provides an optional endpoint to fallback to in emergencies
+	FastestURL  string `json:"fastest_url,omitempty" yaml:"fastest_url,omitempty"`   // is the fastest endpoint based on a head request
+	// CustomRegions holds endpoints for regions not covered by the fields above, keyed by AWS region name, e.g sa-east-1
+	CustomRegions map[string]string `json:"custom_regions,omitempty" yaml:"custom_regions,omitempty"`
+	// the zones hold more URLs of a region, e.g one per availability zone, each of them is probed on its own and the fastest one is selected
+	AsiaPacificZones []string `json:"asia_pacific_zones,omitempty" yaml:"asia_pacific_zones,omitempty"`
+	EuropeZones      []string `json:"europe_zones,omitempty" yaml:"europe_zones,omitempty"`
+	USEastZones      []string `json:"us_east_zones,omitempty" yaml:"us_east_zones,omitempty"`
+	USWestZones      []string `json:"us_west_zones,omitempty" yaml:"us_west_zones,omitempty"`
+	// CustomRegionZones holds more URLs of the custom regions, keyed like CustomRegions
+	CustomRegionZones map[string][]string `json:"custom_region_zones,omitempty" yaml:"custom_region_zones,omitempty"`
+	// Fallbacks are last resort endpoints tried in order after Fallback, when Fallback failed its last probe the next healthy one is used
+	Fallbacks []string `json:"fallbacks,omitempty" yaml:"fallbacks,omitempty"`
+	// Tags labels endpoints for GetURLForTag, keyed by endpoint URL, e.g {"https://eu.foo.com": {"tier": "premium"}}
+	Tags map[string]map[string]string `json:"tags,omitempty" yaml:"tags,omitempty"`
+}
+
+// namedEndpoint pairs an endpoint with the field or custom region it's configured under
+type namedEndpoint struct {
+	name string
+	url  string
 }
 
+// namedEndpoints returns every non empty endpoint in field order, followed by the custom regions sorted by region and the fallbacks
+// the zones of a region follow its field and are named after it, so they're validated and excluded from probes along with it
 // normally reflection should be avoided because it's very slow
-// however, because this method is called once at initialization, this should be okay
-func (e EndPoints) validate() error {
-	var atLeastOne int
+// however, because this method is only called during validation, this should be okay
+func (e EndPoints) namedEndpoints() []namedEndpoint {
+	var endpoints []namedEndpoint
 	v := reflect.ValueOf(e)
 	for i := 0; i < v.NumField(); i++ {
-		if endpoint := v.Field(i).Interface(); len(endpoint.(string)) > 1 {
-			u, err := url.Parse(endpoint.(string))
-			if err != nil {
-				return errors.Wrap(err, fmt.Sprintf("url parsing error on %v: %v", v.Field(i), endpoint))
-			}
+		if v.Field(i).Kind() != reflect.String {
+			continue
+		}
+		name := v.Type().Field(i).Name
+		if endpoint := v.Field(i).String(); len(endpoint) > 1 {
+			endpoints = append(endpoints, namedEndpoint{name: name, url: endpoint})
+		}
+		for _, endpoint := range e.fieldZones(name) {
+			// like Fallbacks an empty entry is kept, so it fails validation instead of being silently skipped
+			endpoints = append(endpoints, namedEndpoint{name: name, url: endpoint})
+		}
+	}
 
-			if len(u.Scheme) == 0 {
-				return errors.Wrap(ErrMissingProtocol, fmt.Sprintf("missing protocol, on %v: %v", v.Field(i), endpoint))
-			}
-			atLeastOne++
+	for _, region := range e.customRegionNames() {
+		if endpoint := e.CustomRegions[region]; len(endpoint) > 0 {
+			endpoints = append(endpoints, namedEndpoint{name: region, url: endpoint})
+		}
+		for _, endpoint := range e.CustomRegionZones[region] {
+			endpoints = append(endpoints, namedEndpoint{name: region, url: endpoint})
+		}
+	}
+
+	for i, endpoint := range e.Fallbacks {
+		// unlike the fields an empty entry is kept, so it fails validation instead of being silently skipped
+		endpoints = append(endpoints, namedEndpoint{name: fmt.Sprintf("Fallbacks[%d]", i), url: endpoint})
+	}
+	return endpoints
+}
+
+// fieldZones returns the zones of the region field with the given name, the other fields have none
+func (e EndPoints) fieldZones(name string) []string {
+	switch name {
+	case "AsiaPacific":
+		return e.AsiaPacificZones
+	case "Europe":
+		return e.EuropeZones
+	case "USEast":
+		return e.USEastZones
+	case "USWest":
+		return e.USWestZones
+	}
+	return nil
+}
+
+// customRegionNames returns the sorted names of the custom regions with an endpoint or zones
+// map iteration is random, sorting keeps the order stable between calls
+func (e EndPoints) customRegionNames() []string {
+	regions := make([]string, 0, len(e.CustomRegions)+len(e.CustomRegionZones))
+	for region := range e.CustomRegions {
+		regions = append(regions, region)
+	}
+	for region := range e.CustomRegionZones {
+		if _, ok := e.CustomRegions[region]; !ok {
+			regions = append(regions, region)
+		}
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+// Validate runs the checks the router constructors run, e.g to report config problems before constructing a router
+// it makes no network calls, see ValidateWithDNS to also make sure every host resolves
+func (e EndPoints) Validate() error {
+	return e.validate()
+}
+
+// validate checks the endpoints, a lone Universal endpoint is also assigned to FastestURL and Fallback
+// it has a pointer receiver so that assignment reaches the router, the exported Validate leaves the caller's endpoints alone
+func (e *EndPoints) validate() error {
+	var atLeastOne int
+	regional := make(map[string]string)
+	for _, endpoint := range e.namedEndpoints() {
+		if err := validateEndpoint(endpoint.name, endpoint.url); err != nil {
+			return err
+		}
+		atLeastOne++
+
+		// the universal and fallback endpoints are allowed to point at one of the regions on purpose
+		switch endpoint.name {
+		case "Universal", "Fallback", "FastestURL":
+			continue
+		}
+		if strings.HasPrefix(endpoint.name, "Fallbacks[") {
+			continue
 		}
+		if name, ok := regional[endpoint.url]; ok {
+			return errors.Wrap(ErrDuplicateEndpoint, fmt.Sprintf("%v and %v: %v", name, endpoint.name, endpoint.url))
+		}
+		regional[endpoint.url] = endpoint.name
 	}
 
 	if atLeastOne == 0 {
 		return ErrAtLeastOne
 	}
 
+	// a preset fastest URL that isn't a region would be returned by GetURL without ever being probed
+	if len(e.FastestURL) > 0 && !containsString(e.probeEndpoints(), e.FastestURL) {
+		return errors.Wrap(ErrClosestURLMismatch, e.FastestURL)
+	}
+
 	// if there is only a single endpoint for an API and that endpoint is used no matter what part of the world you are in
 	// that is then the fastest endpoint that can be used
 	if atLeastOne == 1 && len(e.Universal) > 0 {
@@ -100,21 +247,213 @@ func (e EndPoints) validate() error {
 	return nil
 }
 
+// ValidateWithDNS runs the same checks as the router constructors and additionally makes sure every endpoint's host resolves
+// it makes network calls, so it's opt-in rather than part of the constructors
+func (e EndPoints) ValidateWithDNS(ctx context.Context) error {
+	if err := e.validate(); err != nil {
+		return err
+	}
+
+	for _, endpoint := range e.namedEndpoints() {
+		// a unix socket has no host to resolve
+		if _, ok := unixSocketPath(endpoint.url); ok {
+			continue
+		}
+
+		u, err := url.Parse(endpoint.url)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("url parsing error on %v: %v", endpoint.name, endpoint.url))
+		}
+
+		if _, err := net.DefaultResolver.LookupHost(ctx, u.Hostname()); err != nil {
+			return errors.Wrap(ErrNoSuchHost, fmt.Sprintf("dns lookup failed on %v: %v: %v", endpoint.name, endpoint.url, err))
+		}
+	}
+	return nil
+}
+
+func validateEndpoint(name, endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("url parsing error on %v: %v", name, endpoint))
+	}
+
+	if len(u.Scheme) == 0 {
+		return errors.Wrap(ErrMissingProtocol, fmt.Sprintf("missing protocol, on %v: %v", name, endpoint))
+	}
+	return nil
+}
+
+// LatencyResult is the outcome of probing an endpoint, failed probes have a Duration of time.Hour
+type LatencyResult struct {
+	URL      string
+	Duration time.Duration
+}
+
 // Latency creates a router based on API latency, in order for endpoints to be checked
 // PingInterval must be set, otherwise it will fallback to relying on AWS regional information if set
 // and lastly to the fallback URL if none of the above is set
 type Latency struct {
-	// incase AWS_REGION is present we will default to that region
+	// incase AWS_REGION, or the region reported by the RegionDetector, is present we will default to that region
 	AWSRegion string
 	// if a client is not passed in as an optional the default network client will be used
 	Client *http.Client
-	// if DebugMode is set logs from the standard log package will be displayed
+	// if DebugMode is set logs from the standard log package will be displayed, it has no effect when a Logger is set
 	DebugMode bool
 	// if PingInterval is not set as an optional endpoints will not be checked for latency periodically
 	PingInterval time.Duration
 	preset       bool
-	shouldGuard  bool
 	stopTicker   chan struct{}
+	stopOnce     sync.Once
+	// done is closed once the ping goroutine returned, or right away when there is none
+	done chan struct{}
+	// probeMu serializes latency checks
+	probeMu sync.Mutex
+	// firstProbe is closed once the first latency check completes
+	firstProbe     chan struct{}
+	firstProbeOnce sync.Once
+	// alwaysProbeAll probes every endpoint on each check, even while the preset endpoint is healthy
+	alwaysProbeAll bool
+	// probeFallback makes the fallback a contender that's probed and can be selected as the fastest endpoint
+	probeFallback bool
+	// failureBackoff caps the interval that's doubled for every check in a row in which all endpoints failed
+	failureBackoff time.Duration
+	// probeOnce runs a single latency check during construction when there is no PingInterval
+	probeOnce bool
+	// initialProbeDelay is the upper bound of the random delay before the ping goroutine's first latency check
+	initialProbeDelay time.Duration
+	// lazyTTL replaces the ping goroutine, GetURL starts a check once the last one is older than lazyTTL
+	// lazyProbing is 1 while such a check runs, lazyProbes tracks its goroutine and lazyMu orders starting one with stopping
+	// lazyCtx is the constructor's context, a check isn't started and a running one is cancelled once it's done
+	lazyTTL     time.Duration
+	lazyProbing int32
+	lazyProbes  sync.WaitGroup
+	lazyMu      sync.Mutex
+	lazyCtx     context.Context
+	// blockUntilReady is how long the constructor waits for the first latency check
+	blockUntilReady time.Duration
+	// pingJitter randomizes each PingInterval by ±pingJitter of itself, jitterRand is only used by the ping goroutine
+	pingJitter float64
+	jitterRand *rand.Rand
+	// probeMethod is the HTTP method used to check endpoints, either HEAD or GET
+	probeMethod string
+	// autoProbeMethod discovers the method per endpoint with an OPTIONS request, endpointMethods caches the outcome
+	autoProbeMethod bool
+	endpointMethods map[string]string
+	// regionDetector determines the region the closest endpoint is picked from before any latency checks
+	regionDetector RegionDetector
+	// latitude and longitude locate the client when hasCoordinates is set, the nearest region is used before any latency checks
+	hasCoordinates      bool
+	latitude, longitude float64
+	// regionMapping resolves the detected region to one of the endpoints
+	regionMapping map[string]func(EndPoints) string
+	// network is the dialer network of the internal probe client, tcp4 or tcp6 forces the IP version
+	network string
+	// resolver resolves the endpoints' hosts for the internal probe client and TCP probes instead of the default resolver
+	resolver *net.Resolver
+	// proxy replaces the environment proxy of the internal probe transport
+	proxy func(*http.Request) (*url.URL, error)
+	// insecureSkipVerify disables certificate verification of the internal probe transport
+	insecureSkipVerify bool
+	// keepWarm, when set, keeps the internal probe transport's connections open between checks or closes them after every probe
+	keepWarm *bool
+	// http2 forces the internal probe transport to negotiate HTTP/2
+	http2 bool
+	// probeRequest returns the request every probe sends instead of a HEAD or GET request, its URL is resolved against each endpoint
+	probeRequest func() *http.Request
+	// probeHeaders are added to every probe request, e.g User-Agent
+	probeHeaders http.Header
+	// probeFunc replaces the network probe of every endpoint when set
+	probeFunc func(ctx context.Context, url string) (time.Duration, error)
+	// tcpProbe measures the time to establish a TCP connection instead of making an HTTP request
+	tcpProbe bool
+	// reachabilityMode counts any HTTP response as a successful probe, only transport errors are failures
+	reachabilityMode bool
+	// acceptableStatus replaces the default 2xx success check
+	acceptableStatus func(code int) bool
+	// endpointStatus replaces acceptableStatus and the default success check for individual endpoint URLs
+	endpointStatus map[string]func(code int) bool
+	// followRedirects times redirects end to end, otherwise the 3xx response itself is the probe result
+	followRedirects bool
+	// shuffleProbeOrder starts the probes in a random order every check, shuffleRand is guarded by probeMu
+	shuffleProbeOrder bool
+	shuffleRand       *rand.Rand
+	// maxConcurrentProbes bounds how many endpoints are probed at the same time, zero means no limit
+	maxConcurrentProbes int
+	// probeRetries is the number of attempts made against an endpoint before it's considered failed
+	probeRetries int
+	// probeBackoff is the time waited between attempts
+	probeBackoff time.Duration
+	// logger receives all debug output, when nil the standard log package is used in DebugMode
+	logger Logger
+	// timeout bounds each probe, it's the client's timeout or the default client's timeout when the client has none
+	timeout time.Duration
+	// endpointTimeouts overrides timeout for individual endpoint URLs
+	endpointTimeouts map[string]time.Duration
+	// certFingerprint is the expected hex encoded sha256 fingerprint of the certificate presented to probes
+	certFingerprint string
+	// clock drives the ping loop and timestamps
+	clock Clock
+	// metrics receives the outcome of every probe
+	metrics MetricsCollector
+	// events receives every probe outcome once Events has been called, eventsMu guards closing it
+	events       chan ProbeEvent
+	eventsClosed bool
+	eventsMu     sync.RWMutex
+	// selector replaces the default lowest duration selection
+	selector func(results []LatencyResult) string
+	// excludeFromProbe holds the EndPoints field names, or custom region names, which are never probed
+	excludeFromProbe map[string]bool
+	// balanceTolerance is how much slower than the fastest endpoint GetBalancedEndpoint may route to
+	balanceTolerance time.Duration
+	// endpointWeights multiply the duration of endpoints before the fastest is selected, keyed by URL
+	endpointWeights map[string]float64
+	// regionalBias is added to the universal endpoint's duration before the fastest endpoint is selected
+	regionalBias time.Duration
+	// stickyThreshold is how much slower the current endpoint may be before it's replaced
+	stickyThreshold time.Duration
+	// override is returned by GetURL before anything else when set
+	override string
+	// onChange is called whenever the fastest endpoint changes
+	onChange func(oldURL, newURL string)
+	// onProbeError is called with the error of every failed probe request
+	onProbeError func(url string, err error)
+	// onAllFailed is called when no endpoint responded during a latency check
+	onAllFailed func()
+	lastErr     error
+	// latencies holds the last measured round trip time for each probed endpoint
+	latencies map[string]time.Duration
+	// failures counts the probes in a row that failed per endpoint
+	failures map[string]int
+	// failureReasons holds why the last probe failed per endpoint, endpoints whose last probe succeeded are absent
+	failureReasons map[string]FailureReason
+	// successes counts the probes in a row that succeeded per endpoint
+	successes map[string]int
+	// minHealthySamples is the number of successes in a row an endpoint needs before it can become the fastest
+	minHealthySamples int
+	// failureThreshold is the number of failures in a row after which an endpoint is skipped for failureCooldown
+	failureThreshold int
+	failureCooldown  time.Duration
+	brokenUntil      map[string]time.Time
+	// backoffUntil holds the endpoints which asked not to be probed until the time with a Retry-After header
+	backoffUntil map[string]time.Time
+	// tlsInfo holds the TLS version and cipher suite each https endpoint negotiated during its last probe
+	tlsInfo map[string]TLSConnectionInfo
+	// lastProbe is when the last latency check completed
+	lastProbe time.Time
+	// staleAfter is how old lastProbe may get before GetURL ignores the selection and returns universal or the fallback
+	staleAfter time.Duration
+	// ready is set once a latency check selected, or confirmed, the fastest endpoint from a real measurement
+	ready bool
+	// sampleWindow is the number of recent probe durations averaged per endpoint when selecting the fastest
+	sampleWindow int
+	samples      map[string]*sampleWindow
+	// selectionPercentile selects on the percentile of the sample window instead of its mean when set, e.g 90
+	selectionPercentile float64
+	// ewma selects on an exponential moving average of the successful probe durations, smoothed holds it per endpoint
+	ewma      bool
+	ewmaAlpha float64
+	smoothed  map[string]time.Duration
 
 	mu sync.RWMutex
 	EndPoints
@@ -122,222 +461,1328 @@ type Latency struct {
 
 // NewLatencyRouter returns a fully initialized network based API router
 // if the inputted client is nil, the default client will be used underneath, which has a 500ms timeout
+// each latency check waits for every probe to finish and then selects the fastest endpoint, rather than taking the first to respond,
+// so a check lasts as long as its slowest probe, up to the client timeout when an endpoint is down, before the selection changes
 func NewLatencyRouter(endpoints EndPoints, options ...func(*Latency)) (*Latency, error) {
+	return NewLatencyRouterContext(context.Background(), endpoints, options...)
+}
+
+// NewLatencyRouterContext is like NewLatencyRouter, but the periodic latency checks stop once the context is done
+func NewLatencyRouterContext(ctx context.Context, endpoints EndPoints, options ...func(*Latency)) (*Latency, error) {
 	if err := endpoints.validate(); err != nil {
 		return nil, err
 	}
 
-	region := strings.ToLower(os.Getenv("AWS_REGION"))
-	if len(region) > 0 {
-		switch region {
-		case "us-east-1", "us-east-2":
-			endpoints.FastestURL = endpoints.USEast
-		case "us-west-1", "us-west-2":
-			endpoints.FastestURL = endpoints.USWest
-		case "ap-south-1", "  ap-southeast-1", "ap-southeast-2":
-			endpoints.FastestURL = endpoints.AsiaPacific
-		case "eu-central-1":
-			endpoints.FastestURL = endpoints.Europe
-		}
-	}
-
 	l := &Latency{
-		AWSRegion:  region,
-		Client:     defaultClient,
-		EndPoints:  endpoints,
-		mu:         sync.RWMutex{},
-		stopTicker: make(chan struct{}, 1),
-		preset:     len(endpoints.FastestURL) > 0,
+		Client:         newRouterClient(),
+		EndPoints:      endpoints,
+		mu:             sync.RWMutex{},
+		stopTicker:     make(chan struct{}),
+		done:           make(chan struct{}),
+		lazyCtx:        ctx,
+		firstProbe:     make(chan struct{}),
+		probeMethod:    http.MethodHead,
+		probeRetries:   1,
+		metrics:        noopMetricsCollector{},
+		sampleWindow:   1,
+		regionDetector: AWSRegionDetector{},
+		regionMapping:  DefaultRegionMapping,
+		clock:          realClock{},
+		// each instance gets its own seed, otherwise every instance would probe in the same order
+		shuffleProbeOrder: true,
+		shuffleRand:       rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 
 	for _, option := range options {
 		option(l)
 	}
+	// the fallback only counts with WithProbeFallback and excluded fields don't, so the options have to be applied first
+	if l.PingInterval.Nanoseconds() > 0 && len(l.contenders()) < 2 {
+		return nil, ErrInsufficientEndpointsForLatency
+	}
+	for endpoint, weight := range l.endpointWeights {
+		if weight <= 0 {
+			return nil, errors.Wrap(ErrInvalidWeight, fmt.Sprintf("%v: %v", endpoint, weight))
+		}
+	}
+	if l.ewma && (l.ewmaAlpha <= 0 || l.ewmaAlpha > 1) {
+		return nil, errors.Wrap(ErrInvalidAlpha, fmt.Sprintf("%v", l.ewmaAlpha))
+	}
+	l.timeout = l.Client.Timeout
+	if l.timeout <= 0 {
+		l.timeout = defaultClient.Timeout
+	}
+	l.buildProbeClient()
 
-	if l.PingInterval.Nanoseconds() > 0.0 {
-		l.shouldGuard = true
-		go l.periodicallyPingEndpoints()
+	region, err := l.regionDetector.Region()
+	if err != nil {
+		l.logf("region could not be detected: %v", err)
+	}
+
+	l.AWSRegion = strings.ToLower(region)
+	if len(l.AWSRegion) > 0 {
+		if endpoint := closestEndpoint(l.AWSRegion, l.EndPoints, l.regionMapping); len(endpoint) > 0 {
+			l.FastestURL = endpoint
+		}
+	}
+	l.preset = len(l.FastestURL) > 0
+
+	if l.PingInterval.Nanoseconds() > 0.0 && l.lazyTTL <= 0 {
+		go l.periodicallyPingEndpoints(ctx)
+	} else {
+		close(l.done)
+		if l.probeOnce {
+			l.findLowLatencyEndpoint(ctx)
+		}
+	}
+	if l.blockUntilReady > 0 {
+		l.waitUntilReady(ctx)
+	}
+
+	return l, nil
+}
+
+// NewStaticRouter returns a router which trusts closest as the fastest endpoint, it never probes and starts no goroutine
+// the endpoints are validated like NewLatencyRouter does and closest has to be one of the regions, otherwise ErrClosestURLMismatch is returned
+func NewStaticRouter(endpoints EndPoints, closest string) (*Latency, error) {
+	endpoints.FastestURL = closest
+	l, err := NewLatencyRouter(endpoints)
+	if err != nil {
+		return nil, err
 	}
 
+	// the detected region must not replace the endpoint that was handed in
+	l.FastestURL = closest
+	l.preset = len(closest) > 0
 	return l, nil
 }
 
+// NewRegionRouter is like NewLatencyRouter, but the closest endpoint is resolved from the inputted region instead of AWS_REGION
+// the region goes through the same region mapping, e.g eu-west-1 resolves to Europe, a region detector passed as an option is ignored
+func NewRegionRouter(endpoints EndPoints, region string, options ...func(*Latency)) (*Latency, error) {
+	return NewLatencyRouter(endpoints, append(options, WithRegionDetector(StaticRegionDetector(region)))...)
+}
+
+// waitUntilReady blocks until the first latency check completes, blockUntilReady elapses or the context is done
+// without a ping goroutine nothing else would run the check, so it's made here bounded by blockUntilReady
+func (l *Latency) waitUntilReady(ctx context.Context) {
+	// e.g WithCustomPingInterval(0) already made the check during construction
+	select {
+	case <-l.firstProbe:
+		return
+	default:
+	}
+
+	if l.PingInterval.Nanoseconds() <= 0 || l.lazyTTL > 0 {
+		ctx, cancel := context.WithTimeout(ctx, l.blockUntilReady)
+		defer cancel()
+		l.findLowLatencyEndpoint(ctx)
+		return
+	}
+
+	timer := time.NewTimer(l.blockUntilReady)
+	defer timer.Stop()
+	select {
+	case <-l.firstProbe:
+	case <-timer.C:
+		l.logf("no endpoint was selected within %v", l.blockUntilReady)
+	case <-ctx.Done():
+	}
+}
+
 // GetURL returns the fastest API endpoint from the inputted latency configuration
 func (l *Latency) GetURL() (u string) {
-	// we only need to guard if and only if the data is being periodically refreshed
-	if l.shouldGuard {
-		l.mu.RLock()
-		defer l.mu.RUnlock()
+	l.lazyProbe()
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if len(l.override) != 0 {
+		return l.override
+	}
+
+	if l.isStale() {
+		// the periodic checks are stuck, a selection that old is not trusted over the safe default
+		if len(l.Universal) != 0 {
+			return l.Universal
+		}
+		return l.firstHealthyFallback()
 	}
 
 	if len(l.FastestURL) != 0 {
 		return l.FastestURL
 	}
 
+	if endpoint := l.CustomRegions[l.AWSRegion]; len(endpoint) != 0 {
+		return endpoint
+	}
+
+	if l.hasCoordinates {
+		if endpoint := nearestEndpoint(l.latitude, l.longitude, l.EndPoints); len(endpoint) != 0 {
+			return endpoint
+		}
+	}
+
 	if len(l.Universal) != 0 {
 		return l.Universal
 	}
 
-	if len(l.Fallback) != 0 {
-		return l.Fallback
-	}
-	return
+	return l.firstHealthyFallback()
 }
 
-// StopPingingEndpoints terminates the ticker used to periodically check endpoints for latency and status
-// it's important this function is called to clean up ticker resources
-func (l *Latency) StopPingingEndpoints() {
-	if l.PingInterval.Nanoseconds() == 0.0 {
+// isStale reports whether the last latency check is older than WithStaleAfter allows, the caller must hold mu
+func (l *Latency) isStale() bool {
+	return l.staleAfter > 0 && !l.lastProbe.IsZero() && l.clock.Now().Sub(l.lastProbe) > l.staleAfter
+}
+
+// lazyProbe starts a latency check in the background when WithLazyProbe is set and the last one is older than the TTL
+// at most one runs at a time, callers don't wait for it and get the current selection meanwhile
+func (l *Latency) lazyProbe() {
+	if l.lazyTTL <= 0 {
+		return
+	}
+
+	l.mu.RLock()
+	fresh := !l.lastProbe.IsZero() && l.clock.Now().Sub(l.lastProbe) <= l.lazyTTL
+	l.mu.RUnlock()
+	if fresh || !atomic.CompareAndSwapInt32(&l.lazyProbing, 0, 1) {
 		return
 	}
 
+	// the stop check and Add share lazyMu with StopPingingEndpoints, so a check either starts before Close waits for it or not at all
+	l.lazyMu.Lock()
+	defer l.lazyMu.Unlock()
 	select {
-	case l.stopTicker <- struct{}{}:
+	case <-l.stopTicker:
+		atomic.StoreInt32(&l.lazyProbing, 0)
+		return
+	case <-l.lazyCtx.Done():
+		atomic.StoreInt32(&l.lazyProbing, 0)
+		return
 	default:
 	}
+
+	l.lazyProbes.Add(1)
+	go func() {
+		defer l.lazyProbes.Done()
+		defer atomic.StoreInt32(&l.lazyProbing, 0)
+		l.findLowLatencyEndpoint(l.lazyCtx)
+	}()
+}
+
+// GetURLWait is like GetURL, but during a cold start it first waits up to timeout for the first latency check to complete
+// once the first check completed it returns right away, so does it without a ping goroutine, which is the only one to make that check
+// with WithLazyProbe it starts the first check and waits for it, unless the router is stopped meanwhile
+func (l *Latency) GetURLWait(timeout time.Duration) string {
+	select {
+	case <-l.firstProbe:
+		return l.GetURL()
+	default:
+	}
+
+	// there is no ping goroutine in lazy mode, so done is already closed
+	stopped := l.done
+	if l.lazyTTL > 0 {
+		l.lazyProbe()
+		stopped = l.stopTicker
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-l.firstProbe:
+	case <-stopped:
+	case <-timer.C:
+		l.logf("no endpoint was selected within %v", timeout)
+	}
+	return l.GetURL()
+}
+
+// firstHealthyFallback walks Fallback and then Fallbacks in order, returning the first one that did not fail its last probe
+// the first one is returned when all of them failed, the caller must hold mu
+func (l *Latency) firstHealthyFallback() string {
+	chain := l.fallbackChain()
+	for _, endpoint := range chain {
+		if latency, ok := l.latencies[endpoint]; !ok || latency < time.Hour {
+			return endpoint
+		}
+	}
+
+	if len(chain) > 0 {
+		return chain[0]
+	}
+	return ""
+}
+
+// fallbackChain returns Fallback followed by Fallbacks, skipping empty entries
+func (l *Latency) fallbackChain() []string {
+	chain := make([]string, 0, len(l.Fallbacks)+1)
+	for _, endpoint := range append([]string{l.Fallback}, l.Fallbacks...) {
+		if len(endpoint) > 0 {
+			chain = append(chain, endpoint)
+		}
+	}
+	return chain
+}
+
+// failoverEndpoints returns the fallback chain endpoints which are not probed as regions
+// they're probed only when Fallbacks is set, so GetURL knows which one to walk past, but they're never selected as the fastest
+func (l *Latency) failoverEndpoints() []string {
+	if len(l.Fallbacks) == 0 {
+		return nil
+	}
+
+	regional := make(map[string]bool)
+	for _, endpoint := range l.probeEndpoints() {
+		regional[endpoint] = true
+	}
+	if l.probeFallback {
+		regional[l.Fallback] = true
+	}
+
+	var endpoints []string
+	for _, endpoint := range l.fallbackChain() {
+		if !regional[endpoint] {
+			regional[endpoint] = true
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// SetOverride pins GetURL to the inputted URL regardless of latency or region, e.g to drain a region during an incident
+// it's safe to call while the router is in use
+func (l *Latency) SetOverride(url string) {
+	l.mu.Lock()
+	l.override = url
+	l.mu.Unlock()
+	l.logf("routing overridden to %s", url)
+}
+
+// ClearOverride removes the URL set by SetOverride, GetURL goes back to picking the fastest endpoint
+func (l *Latency) ClearOverride() {
+	l.mu.Lock()
+	l.override = ""
+	l.mu.Unlock()
+	l.logf("routing override cleared")
+}
+
+// StopPingingEndpoints terminates the ticker used to periodically check endpoints for latency and status
+// it's important this function is called to clean up ticker resources, calling it more than once is a no-op
+func (l *Latency) StopPingingEndpoints() {
+	l.stopOnce.Do(func() {
+		l.lazyMu.Lock()
+		defer l.lazyMu.Unlock()
+		close(l.stopTicker)
+	})
+}
+
+// GetLatencies returns the last measured round trip time for each endpoint URL
+// endpoints that failed or timed out are reported with a duration of time.Hour
+func (l *Latency) GetLatencies() map[string]time.Duration {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	latencies := make(map[string]time.Duration, len(l.latencies))
+	for endpoint, duration := range l.latencies {
+		latencies[endpoint] = duration
+	}
+	return latencies
+}
+
+// IsHealthy reports whether the last probe of the endpoint URL succeeded
+// endpoints that have not been probed yet are reported as unhealthy
+func (l *Latency) IsHealthy(url string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	latency, ok := l.latencies[url]
+	return ok && latency < time.Hour
+}
+
+// Ready reports whether GetURL returns an endpoint picked by a completed latency check
+// until then it returns a guess, e.g the endpoint closest to the detected region or the fallback, that has not been measured
+func (l *Latency) Ready() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.ready
+}
+
+// LastError returns ErrAllEndpointsFailed if no endpoint responded during the last latency check, otherwise nil
+func (l *Latency) LastError() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.lastErr
+}
+
+func (l *Latency) setLastError(err error) {
+	l.mu.Lock()
+	l.lastErr = err
+	l.mu.Unlock()
+}
+
+// Close stops the periodic latency checks and closes the Events channel, it's safe to call multiple times and always returns a nil error
+// it returns once the ping goroutine exited, a latency check in progress is completed first
+func (l *Latency) Close() error {
+	l.StopPingingEndpoints()
+	l.Wait()
+	l.closeEvents()
+	return nil
+}
+
+// Wait blocks until the ping goroutine exited after StopPingingEndpoints, Close or the context being done
+// it returns right away when there is no ping goroutine, a latency check started by WithLazyProbe is waited for as well
+func (l *Latency) Wait() {
+	if l.done != nil {
+		<-l.done
+	}
+	l.lazyProbes.Wait()
 }
 
-func (l *Latency) findLowLatencyEndpoint() {
-	// the container is equal to the number of endpoints to hit
-	// we only care about the first one, this is to help with dead locking
-	quickestEndpointCh := make(chan string, 1)
+// UpdateEndpoints validates and swaps the endpoints at runtime, the closest endpoint is resolved again from the detected region
+// it waits for a latency check in progress to complete, the next check probes the new endpoints
+// measurements of endpoints that are no longer configured are dropped and Ready reports false until the next check, on error the current endpoints are kept
+func (l *Latency) UpdateEndpoints(endpoints EndPoints) error {
+	if err := endpoints.validate(); err != nil {
+		return err
+	}
+	if l.PingInterval.Nanoseconds() > 0 && len(l.contendersOf(endpoints)) < 2 {
+		return ErrInsufficientEndpointsForLatency
+	}
+
+	l.probeMu.Lock()
+	defer l.probeMu.Unlock()
+
+	endpoints.FastestURL = ""
+	if len(l.AWSRegion) > 0 {
+		endpoints.FastestURL = closestEndpoint(l.AWSRegion, endpoints, l.regionMapping)
+	}
+
+	configured := make(map[string]bool)
+	for _, endpoint := range endpoints.namedEndpoints() {
+		configured[endpoint.url] = true
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), l.Client.Timeout)
-	defer cancel()
-	if l.preset {
+	l.mu.Lock()
+	previous := l.FastestURL
+	l.EndPoints = endpoints
+	l.preset = len(endpoints.FastestURL) > 0
+	// the closest endpoint was resolved again but not measured
+	l.ready = false
+	for endpoint := range l.latencies {
+		if !configured[endpoint] {
+			delete(l.latencies, endpoint)
+			delete(l.failures, endpoint)
+			delete(l.failureReasons, endpoint)
+			delete(l.tlsInfo, endpoint)
+			delete(l.endpointMethods, endpoint)
+			delete(l.successes, endpoint)
+			delete(l.samples, endpoint)
+			delete(l.smoothed, endpoint)
+			delete(l.brokenUntil, endpoint)
+			delete(l.backoffUntil, endpoint)
+		}
+	}
+	l.mu.Unlock()
+
+	if l.onChange != nil && previous != endpoints.FastestURL {
+		l.onChange(previous, endpoints.FastestURL)
+	}
+	return nil
+}
+
+// RefreshNow runs a latency check right away and returns once it completes, it's safe to call alongside the periodic checks
+// the context's error is returned if it's done before the check completes, otherwise the result of LastError
+func (l *Latency) RefreshNow(ctx context.Context) error {
+	l.findLowLatencyEndpoint(ctx)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return l.LastError()
+}
+
+func (l *Latency) findLowLatencyEndpoint(ctx context.Context) {
+	// only one latency check runs at a time, whether it comes from the ticker or RefreshNow
+	l.probeMu.Lock()
+	defer l.probeMu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.lastProbe = l.clock.Now()
+		l.mu.Unlock()
+		l.firstProbeOnce.Do(func() { close(l.firstProbe) })
+	}()
+
+	l.mu.RLock()
+	preset := l.FastestURL
+	l.mu.RUnlock()
+	// a preset endpoint that asked for a pause is left alone, the other endpoints are probed instead
+	if l.preset && !l.alwaysProbeAll && !l.excludedFromProbe(preset) && len(l.withoutBackedOffEndpoints([]string{preset})) > 0 {
+		// every attempt on the preset URL shares a single timeout
+		presetCtx, cancel := context.WithTimeout(ctx, l.probeTimeout())
+		defer cancel()
+		var presetErr error
 	loop:
 		// if the preset URL fails
 		for i := 0; i < 3; i++ {
-			// this is a blocking call
-			statusCode, err := l.headRequestPresetEndpoint(l.FastestURL)
-			err = checkResponseError(err)
-			switch err {
+			// this is a blocking call, it probes like every other endpoint, e.g over TCP with WithTCPProbe
+			duration, err := l.probe(presetCtx, preset)
+			if err == nil {
+				l.metrics.ObserveLatency(preset, duration)
+				l.emitEvent(preset, duration, nil)
+			} else {
+				l.metrics.ObserveFailure(preset)
+				l.emitEvent(preset, time.Hour, err)
+			}
+			presetErr = err
+			if err != nil && l.onProbeError != nil {
+				l.onProbeError(preset, err)
+			}
+			if l.backOff(preset, err) {
+				l.logf("present URL %s asked to retry later", preset)
+				break loop
+			}
+			switch checkResponseError(err) {
 			case nil:
-				if (statusCode >= http.StatusOK && statusCode < http.StatusMultipleChoices) && err == nil {
-					quickestEndpointCh <- l.FastestURL
-					l.logf("present URL %s is still good\n", l.FastestURL)
-					break loop
-				}
+				l.recordLatencies(LatencyResult{URL: preset, Duration: duration})
+				l.recordFailureReason(preset, nil)
+				l.mu.Lock()
+				l.lastErr = nil
+				l.ready = true
+				l.mu.Unlock()
+				l.logf("present URL %s is still good", preset)
+				return
 			case ErrTimeout, ErrConnectionReset:
-				l.logf("present URL %s timed out or had it's connection reset\n", l.FastestURL)
+				l.logf("present URL %s timed out or had it's connection reset", preset)
 				// do nothing, let the for loop try again
 			case ErrNoSuchHost:
-				l.logf("present URL %s host could not be found\n", l.FastestURL)
+				l.logf("present URL %s host could not be found", preset)
 				break loop
 			}
 		}
+		// the preset URL could not be confirmed, so every endpoint gets a chance
+		l.recordLatencies(LatencyResult{URL: preset, Duration: time.Hour})
+		l.recordFailureReason(preset, presetErr)
 	}
 
-	// if new endpoints are added the below needs to be updated as well
-	// we could use reflection here to iterate over the items in the struct, but it isn't worth the performance cost
-	if len(quickestEndpointCh) == 0 {
-		// the first one to return is the quickest endpoint
-		go l.headRequest(ctx, l.Universal, quickestEndpointCh)
-		go l.headRequest(ctx, l.USEast, quickestEndpointCh)
-		go l.headRequest(ctx, l.USWest, quickestEndpointCh)
-		go l.headRequest(ctx, l.Europe, quickestEndpointCh)
-		go l.headRequest(ctx, l.AsiaPacific, quickestEndpointCh)
+	regional := l.withoutBackedOffEndpoints(l.contenders())
+	failover := l.withoutBackedOffEndpoints(l.failoverEndpoints())
+	endpoints := l.probeOrder(append(append([]string(nil), regional...), failover...))
+	// the container is equal to the number of endpoints to hit, so no probe ever blocks on sending its result
+	results := make(chan LatencyResult, len(endpoints))
+	// without a limit the semaphore is as large as the number of endpoints, so acquiring it never blocks
+	limit := len(endpoints)
+	if l.maxConcurrentProbes > 0 && l.maxConcurrentProbes < limit {
+		limit = l.maxConcurrentProbes
 	}
+	semaphore := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for _, endpoint := range endpoints {
+		wg.Add(1)
+		go func(endpoint string) {
+			defer wg.Done()
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				// the check was abandoned before it was the endpoint's turn, it wasn't measured so nothing is recorded
+				return
+			}
+			defer func() { <-semaphore }()
+			// the endpoint's timeout starts once it's its turn, waiting for a slot doesn't count against it
+			ctx, cancel := context.WithTimeout(ctx, l.endpointTimeout(endpoint))
+			defer cancel()
+			l.headRequest(ctx, endpoint, results)
+		}(endpoint)
+	}
+	wg.Wait()
+	close(results)
 
-waiting:
-	for {
-		select {
-		case endpoint := <-quickestEndpointCh:
-			l.mu.Lock()
-			l.FastestURL = endpoint
-			l.mu.Unlock()
-			l.logf("fastest chosen URL: %s\n", l.FastestURL)
-			quickestEndpointCh = nil
-			break waiting
-		case <-time.After(l.Client.Timeout): // in-case something happens, this function call shouldn't panic
-			l.logf("all endpoints took longer than : %v, a fast URL could not be chosen\n", l.Client.Timeout)
-			break waiting
+	measured := make([]LatencyResult, 0, len(endpoints))
+	selectable := make([]LatencyResult, 0, len(regional))
+	for result := range results {
+		measured = append(measured, result)
+		if !containsString(failover, result.URL) {
+			selectable = append(selectable, result)
 		}
 	}
-	quickestEndpointCh = nil
-	return
-}
+	l.recordLatencies(measured...)
+	eligible := l.withoutUnprovenEndpoints(l.withoutBrokenEndpoints(selectable))
+	fastest := l.selectFastest(l.withEndpointWeights(l.withRegionalPreference(l.averageLatencies(eligible))))
 
-func (l *Latency) headRequest(ctx context.Context, endpoint string, quickestEndpoint chan string) {
-	if len(endpoint) == 0 {
+	// without endpoints to probe there is nothing that could have failed
+	if len(regional) == 0 {
+		l.setLastError(nil)
 		return
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodHead, endpoint, nil)
-	if err != nil {
+	if len(fastest.URL) == 0 && l.minHealthySamples > 1 && anySucceeded(selectable) {
+		// an endpoint responded but hasn't succeeded often enough in a row yet, so the current selection is kept
+		l.setLastError(nil)
+		l.logf("no endpoint has %d healthy samples in a row yet, keeping the current URL", l.minHealthySamples)
 		return
 	}
 
-	res, err := l.Client.Do(req)
-	if err != nil {
+	if len(fastest.URL) == 0 {
+		l.setLastError(ErrAllEndpointsFailed)
+		l.logf("all endpoints took longer than : %v, a fast URL could not be chosen", l.probeTimeout())
+		if l.onAllFailed != nil {
+			l.onAllFailed()
+		}
 		return
 	}
-	defer res.Body.Close()
 
-	// trust no one
-	go io.Copy(ioutil.Discard, res.Body)
+	l.mu.Lock()
+	l.lastErr = nil
+	l.ready = true
+	previous := l.FastestURL
+	l.FastestURL = fastest.URL
+	l.mu.Unlock()
+	l.logf("fastest chosen URL: %s", fastest.URL)
+
+	// the callback is called outside of the lock, so it's free to call back into the router
+	if l.onChange != nil && previous != fastest.URL {
+		l.onChange(previous, fastest.URL)
+	}
+}
+
+// selectFastest picks the result with the lowest duration, an empty result is returned if every probe failed
+func (l *Latency) selectFastest(measured []LatencyResult) LatencyResult {
+	if l.selector != nil {
+		// the selector gets its own copy, so it can sort or modify the results freely
+		selected := l.selector(append([]LatencyResult(nil), measured...))
+		for _, result := range measured {
+			if result.URL == selected {
+				return result
+			}
+		}
+		return LatencyResult{URL: selected}
+	}
+
+	fastest := LatencyResult{Duration: time.Hour}
+	for _, result := range measured {
+		if result.Duration < fastest.Duration {
+			fastest = result
+		}
+	}
+
+	if l.stickyThreshold <= 0 || len(fastest.URL) == 0 {
+		return fastest
+	}
+
+	// keep the current endpoint if it's within the threshold of the new fastest one, this dampens flapping
+	l.mu.RLock()
+	current := l.FastestURL
+	l.mu.RUnlock()
+	for _, result := range measured {
+		if result.URL == current && result.Duration < time.Hour && result.Duration-fastest.Duration <= l.stickyThreshold {
+			return result
+		}
+	}
+	return fastest
+}
+
+// probeOrder shuffles the endpoints in place when WithShuffleProbeOrder is on, the caller must hold probeMu
+// a transport that serializes on a shared resource would otherwise favor the endpoints listed first
+func (l *Latency) probeOrder(endpoints []string) []string {
+	if l.shuffleProbeOrder {
+		l.shuffleRand.Shuffle(len(endpoints), func(i, j int) {
+			endpoints[i], endpoints[j] = endpoints[j], endpoints[i]
+		})
+	}
+	return endpoints
+}
+
+// probeTimeout bounds a whole latency check, it's the longest timeout of any endpoint
+func (l *Latency) probeTimeout() time.Duration {
+	timeout := l.timeout
+	for _, d := range l.endpointTimeouts {
+		if d > timeout {
+			timeout = d
+		}
+	}
+	return timeout
+}
+
+// endpointTimeout bounds a single probe, endpoints without their own timeout use the client's timeout
+func (l *Latency) endpointTimeout(endpoint string) time.Duration {
+	if d, ok := l.endpointTimeouts[endpoint]; ok && d > 0 {
+		return d
+	}
+	return l.timeout
+}
+
+// probeEndpoints returns every non empty endpoint that should be checked for latency
+// the fallback is purposely left out, it's the safety net and not a contender
+func (e EndPoints) probeEndpoints() []string {
+	// every zone of a region is a contender of its own
+	candidates := []string{e.Universal}
+	candidates = append(append(candidates, e.USEast), e.USEastZones...)
+	candidates = append(append(candidates, e.USWest), e.USWestZones...)
+	candidates = append(append(candidates, e.Europe), e.EuropeZones...)
+	candidates = append(append(candidates, e.AsiaPacific), e.AsiaPacificZones...)
+	for _, region := range e.customRegionNames() {
+		candidates = append(append(candidates, e.CustomRegions[region]), e.CustomRegionZones[region]...)
+	}
+
+	endpoints := make([]string, 0, len(candidates))
+	for _, endpoint := range candidates {
+		if len(endpoint) > 0 {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// contenders returns the endpoints the fastest one is selected from, without the fields excluded with WithExcludeFromProbe
+// the fallback is one of them only with WithProbeFallback
+func (l *Latency) contenders() []string {
+	return l.contendersOf(l.EndPoints)
+}
+
+// contendersOf is contenders for the inputted endpoints instead of the router's, each URL is listed once
+func (l *Latency) contendersOf(e EndPoints) []string {
+	var endpoints []string
+	for _, endpoint := range l.withoutExcludedEndpoints(e, e.probeEndpoints()) {
+		// universal may share its URL with a region
+		if !containsString(endpoints, endpoint) {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	if !l.probeFallback {
+		return endpoints
+	}
+
+	if len(e.Fallback) > 0 && !containsString(endpoints, e.Fallback) {
+		endpoints = append(endpoints, e.Fallback)
+	}
+	return endpoints
+}
+
+func (l *Latency) recordLatencies(results ...LatencyResult) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.latencies == nil {
+		l.latencies = make(map[string]time.Duration, len(results))
+	}
+	if l.samples == nil {
+		l.samples = make(map[string]*sampleWindow, len(results))
+	}
+	if l.failures == nil {
+		l.failures = make(map[string]int, len(results))
+	}
+	if l.successes == nil {
+		l.successes = make(map[string]int, len(results))
+	}
+	for _, result := range results {
+		l.latencies[result.URL] = result.Duration
+		if result.Duration >= time.Hour {
+			l.failures[result.URL]++
+			if l.failureThreshold > 0 && l.failures[result.URL] >= l.failureThreshold {
+				if l.brokenUntil == nil {
+					l.brokenUntil = make(map[string]time.Time)
+				}
+				l.brokenUntil[result.URL] = l.clock.Now().Add(l.failureCooldown)
+			}
+			l.successes[result.URL] = 0
+		} else {
+			l.failures[result.URL] = 0
+			l.successes[result.URL]++
+			l.smooth(result)
+		}
+		window, ok := l.samples[result.URL]
+		if !ok {
+			window = newSampleWindow(l.sampleWindow)
+			l.samples[result.URL] = window
+		}
+		window.add(result.Duration)
+	}
+}
+
+// withoutBrokenEndpoints drops the endpoints that failed too often in a row and are still cooling down
+func (l *Latency) withoutBrokenEndpoints(measured []LatencyResult) []LatencyResult {
+	l.mu.RLock()
+	if len(l.brokenUntil) == 0 {
+		l.mu.RUnlock()
+		return measured
+	}
+
+	now := l.clock.Now()
+	eligible := make([]LatencyResult, 0, len(measured))
+	var skipped []string
+	for _, result := range measured {
+		if until, ok := l.brokenUntil[result.URL]; ok && now.Before(until) {
+			skipped = append(skipped, result.URL)
+			continue
+		}
+		eligible = append(eligible, result)
+	}
+	l.mu.RUnlock()
+
+	for _, endpoint := range skipped {
+		l.logf("skipping %s, it failed too often in a row and is cooling down", endpoint)
+	}
+	return eligible
+}
 
-	if !(res.StatusCode >= http.StatusOK && res.StatusCode < http.StatusMultipleChoices) {
+// withoutUnprovenEndpoints drops the endpoints that haven't succeeded minHealthySamples probes in a row
+// the current fastest endpoint is always kept, so it can only be replaced by a proven one
+func (l *Latency) withoutUnprovenEndpoints(measured []LatencyResult) []LatencyResult {
+	if l.minHealthySamples <= 1 {
+		return measured
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	proven := make([]LatencyResult, 0, len(measured))
+	for _, result := range measured {
+		if result.URL == l.FastestURL || l.successes[result.URL] >= l.minHealthySamples {
+			proven = append(proven, result)
+		}
+	}
+	return proven
+}
+
+// anySucceeded reports whether at least one of the results is a successful probe
+func anySucceeded(results []LatencyResult) bool {
+	for _, result := range results {
+		if result.Duration < time.Hour {
+			return true
+		}
+	}
+	return false
+}
+
+// withEndpointWeights multiplies the duration of every endpoint by its weight, endpoints without a weight are left as is
+func (l *Latency) withEndpointWeights(measured []LatencyResult) []LatencyResult {
+	if len(l.endpointWeights) == 0 {
+		return measured
+	}
+
+	weighted := make([]LatencyResult, 0, len(measured))
+	for _, result := range measured {
+		if weight, ok := l.endpointWeights[result.URL]; ok && result.Duration < time.Hour {
+			result.Duration = time.Duration(float64(result.Duration) * weight)
+		}
+		weighted = append(weighted, result)
+	}
+	return weighted
+}
+
+// withRegionalPreference adds regionalBias to the duration of the universal endpoint, so it only wins when it's clearly faster
+// a universal endpoint which is also configured as a region is left as is
+func (l *Latency) withRegionalPreference(measured []LatencyResult) []LatencyResult {
+	if l.regionalBias <= 0 {
+		return measured
+	}
+
+	biased := make([]LatencyResult, 0, len(measured))
+	for _, result := range measured {
+		if result.Duration < time.Hour && l.EndPoints.regionLabel(result.URL) == "universal" {
+			result.Duration += l.regionalBias
+		}
+		biased = append(biased, result)
+	}
+	return biased
+}
+
+// averageLatencies replaces the duration of each result with the mean of the endpoint's sample window
+func (l *Latency) averageLatencies(measured []LatencyResult) []LatencyResult {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	averaged := make([]LatencyResult, 0, len(measured))
+	for _, result := range measured {
+		if smoothed, ok := l.smoothed[result.URL]; ok && l.ewma && result.Duration < time.Hour {
+			// a failed probe still fails the endpoint, the average only smooths the successful ones
+			result.Duration = smoothed
+		} else if window, ok := l.samples[result.URL]; ok && !l.ewma && result.Duration < time.Hour {
+			// a failed probe fails the endpoint as well, otherwise its earlier successes would keep it selectable
+			result.Duration = window.mean()
+			if l.selectionPercentile > 0 {
+				result.Duration = window.percentile(l.selectionPercentile)
+			}
+		}
+		averaged = append(averaged, result)
+	}
+	return averaged
+}
+
+// smooth folds a successful probe into the endpoint's moving average, the first probe starts it, the caller must hold mu
+func (l *Latency) smooth(result LatencyResult) {
+	if !l.ewma {
 		return
 	}
+	if l.smoothed == nil {
+		l.smoothed = make(map[string]time.Duration)
+	}
 
-	// send back the fast endpoint
-	select {
-	case quickestEndpoint <- endpoint:
-	default:
+	previous, ok := l.smoothed[result.URL]
+	if !ok {
+		l.smoothed[result.URL] = result.Duration
+		return
 	}
+	l.smoothed[result.URL] = time.Duration(l.ewmaAlpha*float64(result.Duration) + (1-l.ewmaAlpha)*float64(previous))
+}
+
+// headRequest always sends exactly one result, failed requests are reported with a duration of time.Hour
+func (l *Latency) headRequest(ctx context.Context, endpoint string, results chan<- LatencyResult) {
+	result := LatencyResult{URL: endpoint, Duration: time.Hour}
+	var probeErr error
+	defer func() {
+		if result.Duration < time.Hour {
+			l.metrics.ObserveLatency(endpoint, result.Duration)
+		} else {
+			l.metrics.ObserveFailure(endpoint)
+			if probeErr == nil {
+				probeErr = ctx.Err()
+			}
+		}
+		l.recordFailureReason(endpoint, probeErr)
+		l.emitEvent(endpoint, result.Duration, probeErr)
+		results <- result
+	}()
+
+	for attempt := 0; attempt < l.probeRetries; attempt++ {
+		if attempt > 0 {
+			// the backoff must respect the request deadline, a slow endpoint can't exceed the client timeout
+			select {
+			case <-time.After(l.probeBackoff):
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		duration, err := l.probe(ctx, endpoint)
+		if err == nil {
+			result.Duration = duration
+			return
+		}
+		probeErr = err
+		l.logf("probe %d of %d for %s failed: %v", attempt+1, l.probeRetries, endpoint, err)
+		if l.onProbeError != nil {
+			l.onProbeError(endpoint, err)
+		}
 
-	return
+		// the endpoint asked for a pause, retrying right away would ignore that
+		if l.backOff(endpoint, err) {
+			return
+		}
+	}
+}
+
+// backOff records the time until which the endpoint asked not to be probed, it reports whether err carried a Retry-After
+func (l *Latency) backOff(endpoint string, err error) bool {
+	retryErr, ok := err.(retryAfterError)
+	if !ok {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.backoffUntil == nil {
+		l.backoffUntil = make(map[string]time.Time)
+	}
+	l.backoffUntil[endpoint] = retryErr.until
+	return true
+}
+
+// withoutExcludedEndpoints removes the URLs of the fields of e excluded with WithExcludeFromProbe
+// a URL is kept when another probed field shares it
+func (l *Latency) withoutExcludedEndpoints(e EndPoints, endpoints []string) []string {
+	if len(l.excludeFromProbe) == 0 {
+		return endpoints
+	}
+
+	probed := make(map[string]bool)
+	for _, endpoint := range e.namedEndpoints() {
+		switch {
+		case endpoint.name == "Fallback", endpoint.name == "FastestURL", strings.HasPrefix(endpoint.name, "Fallbacks["):
+			continue
+		case !l.excludeFromProbe[endpoint.name]:
+			probed[endpoint.url] = true
+		}
+	}
+
+	kept := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if probed[endpoint] {
+			kept = append(kept, endpoint)
+		}
+	}
+	return kept
+}
+
+// excludedFromProbe reports whether the URL only belongs to fields excluded with WithExcludeFromProbe
+func (l *Latency) excludedFromProbe(endpoint string) bool {
+	return len(l.withoutExcludedEndpoints(l.EndPoints, []string{endpoint})) == 0
+}
+
+// withoutBackedOffEndpoints drops the endpoints that asked not to be probed for a while with a Retry-After header
+func (l *Latency) withoutBackedOffEndpoints(endpoints []string) []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if len(l.backoffUntil) == 0 {
+		return endpoints
+	}
+
+	now := l.clock.Now()
+	allowed := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if until, ok := l.backoffUntil[endpoint]; ok && now.Before(until) {
+			continue
+		}
+		allowed = append(allowed, endpoint)
+	}
+	return allowed
 }
 
-func (l *Latency) headRequestPresetEndpoint(endpoint string) (int, error) {
-	if len(endpoint) == 0 {
-		return 0, ErrNoSuchHost
+// probe makes a single request against the endpoint and returns the round trip time
+func (l *Latency) probe(ctx context.Context, endpoint string) (time.Duration, error) {
+	if l.probeFunc != nil {
+		return l.probeFunc(ctx, endpoint)
 	}
 
-	res, err := l.Client.Head(endpoint)
+	if l.tcpProbe {
+		return dialProbe(ctx, l.network, l.resolver, endpoint)
+	}
+
+	client, target := l.probeTarget(endpoint)
+	req, err := l.probeRequestFor(ctx, endpoint, target)
 	if err != nil {
 		return 0, err
 	}
-	defer res.Body.Close()
 
-	// trust no one
-	go io.Copy(ioutil.Discard, res.Body)
+	start := time.Now()
+	res, err := client.Do(req)
+	if err != nil {
+		// the error is kept as is for WithOnProbeError, it's classified where a decision depends on it
+		return 0, err
+	}
+	duration := time.Since(start)
+	drainAndClose(res.Body)
+	l.recordTLSInfo(endpoint, res.TLS)
+
+	if !l.reachabilityMode && (res.StatusCode == http.StatusServiceUnavailable || res.StatusCode == http.StatusTooManyRequests) {
+		if until, ok := parseRetryAfter(res.Header.Get("Retry-After"), l.clock.Now()); ok {
+			return 0, retryAfterError{until: until}
+		}
+	}
+
+	if !l.isSuccessStatus(endpoint, res.StatusCode) {
+		return 0, ErrBadStatus
+	}
+	return duration, nil
+}
+
+// newProbeRequest builds the request sent to the endpoint, probe headers are added to the ones set by the standard library
+func (l *Latency) newProbeRequest(ctx context.Context, method, endpoint string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	l.addProbeHeaders(req)
+	return req, nil
+}
+
+// probeRequestFor builds the request a probe of the endpoint sends to the target, the endpoint itself or its unix socket
+// with WithProbeRequest it's a clone of the user's request with its path and query resolved against the target, otherwise a HEAD or GET request
+func (l *Latency) probeRequestFor(ctx context.Context, endpoint, target string) (*http.Request, error) {
+	if l.probeRequest == nil {
+		return l.newProbeRequest(ctx, l.probeMethodFor(ctx, endpoint), target)
+	}
+
+	template := l.probeRequest()
+	if template == nil {
+		return nil, errors.New("the probe request is nil")
+	}
+	base, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	req := template.Clone(ctx)
+	req.URL = base
+	if template.URL != nil {
+		// only the path and query are taken from the template, the scheme, host and credentials always come from the endpoint
+		req.URL = base.ResolveReference(&url.URL{Path: template.URL.Path, RawPath: template.URL.RawPath, RawQuery: template.URL.RawQuery})
+	}
+	// the host of the template would otherwise be sent to every endpoint
+	req.Host = ""
+	req.RequestURI = ""
+	l.addProbeHeaders(req)
+	return req, nil
+}
+
+// addProbeHeaders adds the headers set with WithProbeHeaders to the ones already on the request
+func (l *Latency) addProbeHeaders(req *http.Request) {
+	for key, values := range l.probeHeaders {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	// the Host header is ignored by the client, it has to be set on the request itself
+	if host := l.probeHeaders.Get("Host"); len(host) > 0 {
+		req.Host = host
+	}
+}
+
+// probeMethodFor returns the method the endpoint is probed with
+// with WithAutoProbeMethod it's discovered with an OPTIONS request the first time, HEAD is used while it can't be discovered
+func (l *Latency) probeMethodFor(ctx context.Context, endpoint string) string {
+	if !l.autoProbeMethod {
+		return l.probeMethod
+	}
+
+	l.mu.RLock()
+	method, ok := l.endpointMethods[endpoint]
+	l.mu.RUnlock()
+	if ok {
+		return method
+	}
+
+	method, err := l.discoverProbeMethod(ctx, endpoint)
+	if err != nil {
+		// nothing is cached, so the discovery is tried again with the next probe
+		l.logf("the probe method of %s could not be discovered, HEAD is used: %v", endpoint, err)
+		return http.MethodHead
+	}
+
+	l.mu.Lock()
+	if l.endpointMethods == nil {
+		l.endpointMethods = make(map[string]string)
+	}
+	l.endpointMethods[endpoint] = method
+	l.mu.Unlock()
+	l.logf("%s is probed with %s", endpoint, method)
+	return method
+}
+
+// discoverProbeMethod asks the endpoint which methods it allows, HEAD is preferred over GET
+// an endpoint that answers without an Allow header, or allows neither of them, is probed with HEAD
+func (l *Latency) discoverProbeMethod(ctx context.Context, endpoint string) (string, error) {
+	client, target := l.probeTarget(endpoint)
+	req, err := l.newProbeRequest(ctx, http.MethodOptions, target)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", checkResponseError(err)
+	}
+	drainAndClose(res.Body)
+
+	var get bool
+	for _, method := range strings.Split(res.Header.Get("Allow"), ",") {
+		switch strings.ToUpper(strings.TrimSpace(method)) {
+		case http.MethodHead:
+			return http.MethodHead, nil
+		case http.MethodGet:
+			get = true
+		}
+	}
+	if get {
+		return http.MethodGet, nil
+	}
+	return http.MethodHead, nil
+}
+
+// isSuccessStatus is the single definition of a healthy response for every probe, any 2xx is healthy
+// when redirects are not followed a 3xx is healthy as well, the endpoint answered and pointed somewhere else
+// an endpoint's own check set with WithPerEndpointStatus takes precedence over WithAcceptableStatus
+func (l *Latency) isSuccessStatus(endpoint string, code int) bool {
+	if l.reachabilityMode {
+		return true
+	}
+
+	if acceptable, ok := l.endpointStatus[endpoint]; ok && acceptable != nil {
+		return acceptable(code)
+	}
+
+	if l.acceptableStatus != nil {
+		return l.acceptableStatus(code)
+	}
+
+	if code >= http.StatusOK && code < http.StatusMultipleChoices {
+		return true
+	}
+	return !l.followRedirects && code >= http.StatusMultipleChoices && code < http.StatusBadRequest
+}
+
+// retryAfterError is returned by a probe when the endpoint answered with a Retry-After header
+type retryAfterError struct {
+	until time.Time
+}
+
+func (e retryAfterError) Error() string {
+	return fmt.Sprintf("%v, the endpoint asked to retry after %v", ErrBadStatus, e.until.Format(time.RFC3339))
+}
+
+// parseRetryAfter understands both forms of the Retry-After header, a number of seconds or an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Time, bool) {
+	if len(value) == 0 {
+		return time.Time{}, false
+	}
 
-	if res.StatusCode != http.StatusOK {
-		return res.StatusCode, ErrBadStatus
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return time.Time{}, false
+		}
+		return now.Add(time.Duration(seconds) * time.Second), true
 	}
 
-	return res.StatusCode, nil
+	if date, err := http.ParseTime(value); err == nil {
+		return date, true
+	}
+	return time.Time{}, false
 }
 
-func (l *Latency) log(v ...interface{}) {
-	if l.DebugMode {
-		log.Println(v...)
+// dialProbe measures the time it takes to establish a TCP connection to the endpoint's host, or to its socket for a unix scheme endpoint
+func dialProbe(ctx context.Context, network string, resolver *net.Resolver, endpoint string) (time.Duration, error) {
+	address, err := dialAddress(endpoint)
+	if err != nil {
+		return 0, err
 	}
+
+	if socket, ok := unixSocketPath(endpoint); ok {
+		network, address = "unix", socket
+	}
+	if len(network) == 0 {
+		network = "tcp"
+	}
+
+	dialer := net.Dialer{Resolver: resolver}
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return 0, err
+	}
+	duration := time.Since(start)
+	conn.Close()
+	return duration, nil
+}
+
+// dialAddress returns the host and port of the endpoint, the port defaults to the scheme's port
+func dialAddress(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	port := u.Port()
+	if len(port) == 0 {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
 }
 
+// logf routes all output through the configured logger, by default the standard log package is only used in DebugMode
 func (l *Latency) logf(format string, v ...interface{}) {
-	if l.DebugMode {
-		log.Printf(format, v...)
+	if l.logger == nil && !l.DebugMode {
+		return
+	}
+
+	// endpoints may embed basic auth credentials, those are masked before anything is logged
+	v = redactUserinfo(v)
+	if l.logger != nil {
+		l.logger.Debugf(format, v...)
+		return
 	}
+	stdLogger{}.Debugf(format, v...)
 }
 
-func (l *Latency) periodicallyPingEndpoints() {
+func (l *Latency) periodicallyPingEndpoints(ctx context.Context) {
+	defer close(l.done)
+	if !l.waitInitialProbeDelay(ctx) {
+		return
+	}
 	// do an initial check before ticking
-	l.findLowLatencyEndpoint()
+	l.findLowLatencyEndpoint(ctx)
+	failedChecks := l.countFailedCheck(0)
 	// then tick away for potential updates
-	ticker := time.NewTicker(l.PingInterval)
+	ticker := l.clock.NewTicker(l.nextPingInterval(failedChecks))
+	defer func() {
+		ticker.Stop()
+	}()
 	for {
 		select {
-		case <-ticker.C:
-			l.log("pinging endpoints for latency")
-			l.findLowLatencyEndpoint()
+		case <-ticker.C():
+			l.logf("pinging endpoints for latency")
+			l.findLowLatencyEndpoint(ctx)
+			failedChecks = l.countFailedCheck(failedChecks)
+			if l.pingJitter > 0 || l.failureBackoff > 0 {
+				// every tick gets its own jittered or backed off interval, so instances started together drift apart
+				ticker.Stop()
+				ticker = l.clock.NewTicker(l.nextPingInterval(failedChecks))
+			}
 		case <-l.stopTicker:
-			ticker.Stop()
 			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// waitInitialProbeDelay waits a random duration up to initialProbeDelay, it returns false when the router was stopped meanwhile
+func (l *Latency) waitInitialProbeDelay(ctx context.Context) bool {
+	if l.initialProbeDelay <= 0 {
+		return true
+	}
+
+	// each instance gets its own seed, otherwise instances started together would wait the same time
+	delay := time.Duration(rand.New(rand.NewSource(time.Now().UnixNano())).Int63n(int64(l.initialProbeDelay) + 1))
+	if delay <= 0 {
+		return true
+	}
+	l.logf("delaying the first latency check by %v", delay)
+	ticker := l.clock.NewTicker(delay)
+	defer ticker.Stop()
+	select {
+	case <-ticker.C():
+		return true
+	case <-l.stopTicker:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// countFailedCheck returns the number of checks in a row in which every endpoint failed, including the last one
+func (l *Latency) countFailedCheck(failedChecks int) int {
+	if errors.Cause(l.LastError()) == ErrAllEndpointsFailed {
+		return failedChecks + 1
+	}
+	return 0
+}
+
+// drainAndClose reads the body to completion before closing it, so the underlying connection can be reused
+func drainAndClose(body io.ReadCloser) {
+	// trust no one, even HEAD responses are drained
+	io.Copy(ioutil.Discard, body)
+	body.Close()
+}
+
+// nextPingInterval returns PingInterval randomized by ±pingJitter of itself
+func (l *Latency) nextPingInterval(failedChecks int) time.Duration {
+	interval := l.PingInterval
+	// while every endpoint keeps failing the interval doubles per check, up to failureBackoff
+	if l.failureBackoff > l.PingInterval {
+		for i := 0; i < failedChecks && interval < l.failureBackoff; i++ {
+			interval *= 2
+		}
+		if interval > l.failureBackoff {
+			interval = l.failureBackoff
 		}
 	}
+
+	if l.pingJitter <= 0 {
+		return interval
+	}
+
+	offset := (l.jitterRand.Float64()*2 - 1) * l.pingJitter * float64(interval)
+	return interval + time.Duration(offset)
 }
 
 func checkResponseError(err error) error {
@@ -353,3 +1798,13 @@ func checkResponseError(err error) error {
 	}
 	return nil
 }
+
+// containsString reports whether value is one of values
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -3,27 +3,35 @@ package router
 import (
 	"context"
 	"crypto/tls"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"go.uber.org/goleak"
 )
 
 func TestEndPoints_validate(t *testing.T) {
 	os.Setenv("AWS_REGION", "")
 	type fields struct {
-		AsiaPacific string
-		Europe      string
-		Universal   string
-		USEast      string
-		USWest      string
-		Fallback    string
-		FastestURL  string
+		AsiaPacific   string
+		Europe        string
+		Universal     string
+		USEast        string
+		USWest        string
+		Fallback      string
+		FastestURL    string
+		CustomRegions map[string]string
+		Fallbacks     []string
+		EuropeZones   []string
 	}
 	tests := []struct {
 		name    string
@@ -85,6 +93,120 @@ func TestEndPoints_validate(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "should fail, a custom region is missing the protocol",
+			fields: fields{
+				Fallback:      "https://fallback.foobar.com",
+				CustomRegions: map[string]string{"sa-east-1": "sa-east.foobar.com"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "should pass, custom regions are proper",
+			fields: fields{
+				Fallback:      "https://fallback.foobar.com",
+				CustomRegions: map[string]string{"sa-east-1": "https://sa-east.foobar.com"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "should fail, two regions share an endpoint",
+			fields: fields{
+				USEast:   "https://us.foobar.com",
+				USWest:   "https://us.foobar.com",
+				Fallback: "https://fallback.foobar.com",
+			},
+			wantErr: true,
+		},
+		{
+			name: "should fail, a custom region shares an endpoint with a region",
+			fields: fields{
+				Europe:        "https://eu.foobar.com",
+				Fallback:      "https://fallback.foobar.com",
+				CustomRegions: map[string]string{"eu-west-1": "https://eu.foobar.com"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "should pass, the fallback and universal may share an endpoint with a region",
+			fields: fields{
+				Universal: "https://us.foobar.com",
+				USEast:    "https://us.foobar.com",
+				Fallback:  "https://us.foobar.com",
+			},
+			wantErr: false,
+		},
+		{
+			name: "should fail, one zone of a region is missing the protocol",
+			fields: fields{
+				Europe:      "https://eu-a.foobar.com",
+				EuropeZones: []string{"eu-b.foobar.com"},
+				Fallback:    "https://fallback.foobar.com",
+			},
+			wantErr: true,
+		},
+		{
+			name: "should fail, a zone is the url of another region",
+			fields: fields{
+				Europe:      "https://eu-a.foobar.com",
+				USEast:      "https://us-east.foobar.com",
+				EuropeZones: []string{"https://us-east.foobar.com"},
+				Fallback:    "https://fallback.foobar.com",
+			},
+			wantErr: true,
+		},
+		{
+			name: "should pass, every zone of a region is proper",
+			fields: fields{
+				Europe:      "https://eu-a.foobar.com",
+				EuropeZones: []string{"https://eu-b.foobar.com", "https://eu-c.foobar.com"},
+				Fallback:    "https://fallback.foobar.com",
+			},
+			wantErr: false,
+		},
+		{
+			name: "should pass, a comma is part of the url",
+			fields: fields{
+				Europe:   "https://api.foobar.com/v1?regions=us,eu",
+				Fallback: "https://fallback.foobar.com",
+			},
+			wantErr: false,
+		},
+		{
+			name: "should fail, the fastest url is not a region",
+			fields: fields{
+				USEast:     "https://us-east.foobar.com",
+				Fallback:   "https://fallback.foobar.com",
+				FastestURL: "https://fallback.foobar.com",
+			},
+			wantErr: true,
+		},
+		{
+			name: "should pass, the fastest url is a region",
+			fields: fields{
+				USEast:     "https://us-east.foobar.com",
+				Fallback:   "https://fallback.foobar.com",
+				FastestURL: "https://us-east.foobar.com",
+			},
+			wantErr: false,
+		},
+		{
+			name: "should fail, a fallback in the chain is missing the protocol",
+			fields: fields{
+				Fallback:  "https://fallback.foobar.com",
+				Fallbacks: []string{"https://fallback-2.foobar.com", "fallback-3.foobar.com"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "should pass, the fallback chain may share endpoints with regions",
+			fields: fields{
+				USEast:    "https://us.foobar.com",
+				Fallback:  "https://fallback.foobar.com",
+				Fallbacks: []string{"https://us.foobar.com", "https://fallback-2.foobar.com"},
+			},
+			wantErr: false,
+		},
 		{
 			name: "should pass, there is at least one endpoint",
 			fields: fields{
@@ -97,17 +219,77 @@ func TestEndPoints_validate(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			e := EndPoints{
-				AsiaPacific: tt.fields.AsiaPacific,
-				Europe:      tt.fields.Europe,
-				Universal:   tt.fields.Universal,
-				USEast:      tt.fields.USEast,
-				USWest:      tt.fields.USWest,
-				Fallback:    tt.fields.Fallback,
-				FastestURL:  tt.fields.FastestURL,
+				AsiaPacific:   tt.fields.AsiaPacific,
+				Europe:        tt.fields.Europe,
+				Universal:     tt.fields.Universal,
+				USEast:        tt.fields.USEast,
+				USWest:        tt.fields.USWest,
+				Fallback:      tt.fields.Fallback,
+				FastestURL:    tt.fields.FastestURL,
+				CustomRegions: tt.fields.CustomRegions,
+				Fallbacks:     tt.fields.Fallbacks,
+				EuropeZones:   tt.fields.EuropeZones,
 			}
 			if err := e.validate(); (err != nil) != tt.wantErr {
 				t.Errorf("EndPoints.validate() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if err := e.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("EndPoints.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewLatencyRouter_universalOnly(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	endpoints := EndPoints{Universal: "https://universal.foobar.com"}
+	l, err := NewLatencyRouter(endpoints)
+	if err != nil {
+		t.Fatalf("NewLatencyRouter() error %v", err)
+	}
+	if l.Fallback != endpoints.Universal || l.FastestURL != endpoints.Universal {
+		t.Fatalf("NewLatencyRouter() got Fallback %q and FastestURL %q wanted both to be %s", l.Fallback, l.FastestURL, endpoints.Universal)
+	}
+
+	if err := endpoints.Validate(); err != nil || len(endpoints.Fallback) != 0 {
+		t.Fatalf("EndPoints.Validate() got %v and modified the endpoints to %+v", err, endpoints)
+	}
+}
+
+func TestEndPoints_ValidateWithDNS(t *testing.T) {
+	tests := []struct {
+		name      string
+		endpoints EndPoints
+		wantErr   error
+	}{
+		{
+			name: "should pass when every host resolves",
+			endpoints: EndPoints{
+				USEast:   "http://localhost:8080",
+				Fallback: "http://127.0.0.1:8080",
+			},
+		},
+		{
+			name: "should fail when a host does not resolve",
+			endpoints: EndPoints{
+				USEast:   "http://us-east.foobar.invalid",
+				Fallback: "http://localhost:8080",
+			},
+			wantErr: ErrNoSuchHost,
+		},
+		{
+			name: "should run the regular validation first",
+			endpoints: EndPoints{
+				USEast: "http://localhost:8080",
+			},
+			wantErr: ErrFallbackUnset,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.endpoints.ValidateWithDNS(context.Background()); errors.Cause(err) != tt.wantErr {
+				t.Fatalf("EndPoints.ValidateWithDNS() error = %v, wanted %v", err, tt.wantErr)
+			}
 		})
 	}
 }
@@ -153,7 +335,7 @@ func TestLatency_findLowLatencyEndpoint(t *testing.T) {
 			},
 		},
 		{
-			name: "should use the fallback",
+			name: "should refuse latency routing with only a fallback",
 			args: args{
 				currentLocal: "fallback",
 				useFallback:  true,
@@ -199,7 +381,7 @@ func TestLatency_findLowLatencyEndpoint(t *testing.T) {
 			}
 
 			l, _ := NewLatencyRouter(endpoints, client)
-			l.findLowLatencyEndpoint()
+			l.findLowLatencyEndpoint(context.Background())
 
 			if !strings.Contains(l.GetURL(), tt.args.currentLocal) {
 				t.Fatalf("Latency.findLowLatencyEndpoint() got %s wanted an endpoint containing %s", l.FastestURL, tt.args.currentLocal)
@@ -276,7 +458,7 @@ func TestLatency_findLowLatencyEndpointWithRegion(t *testing.T) {
 				USWest:      "http://foobar.com?region=us-west",
 				Fallback:    "http://foobar.com?region=fallback",
 			}, client)
-			l.findLowLatencyEndpoint()
+			l.findLowLatencyEndpoint(context.Background())
 
 			// should always be apac because it was set by the region
 			if !strings.Contains(l.GetURL(), "apac") {
@@ -287,116 +469,89 @@ func TestLatency_findLowLatencyEndpointWithRegion(t *testing.T) {
 	}
 }
 
-func TestLatency_periodicallyPingEndpoints(t *testing.T) {
-	defer goleak.VerifyNone(t)
-	if testing.Short() {
-		t.Skip("skipping")
-	}
-
-	os.Setenv("AWS_REGION", "")
-	type args struct {
-		currentLocal string
-		useFallback  bool
-	}
-	tests := []struct {
-		name string
-		args args
-	}{
-		{
-			name: "should pick us-east because we are located in us-east",
-			args: args{
-				currentLocal: "us-east",
-			},
-		},
-		{
-			name: "should pick us-west because we are located in us-west",
-			args: args{
-				currentLocal: "us-west",
-			},
-		},
-		{
-			name: "should pick apac because we are located in apac",
-			args: args{
-				currentLocal: "apac",
-			},
-		},
-		{
-			name: "should pick eu because we are located in eu",
-			args: args{
-				currentLocal: "eu",
-			},
-		},
-		{
-			name: "should pick eu because we are located in eu",
-			args: args{
-				currentLocal: "eu",
-			},
-		},
-		{
-			name: "should use the fallback",
-			args: args{
-				currentLocal: "fallback",
-				useFallback:  true,
-			},
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				if len(tt.args.currentLocal) == 0 {
+func TestLatency_findLowLatencyEndpointCustomRegion(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.String(), "sa-east") {
+			time.Sleep(20 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
 
-				}
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
 
-				switch {
-				case strings.Contains(r.URL.String(), tt.args.currentLocal) || len(tt.args.currentLocal) == 0:
-					// if this is the region it is from "no latency is added"
-				default:
-					time.Sleep(20 * time.Millisecond)
-				}
-				w.WriteHeader(http.StatusOK)
-			})
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
 
-			httpClient, teardown := testingHTTPClient(h)
-			defer teardown()
+	endpoints := EndPoints{
+		Europe:        "http://foobar.com?region=eu",
+		USEast:        "http://foobar.com?region=us-east",
+		Fallback:      "http://foobar.com?region=fallback",
+		CustomRegions: map[string]string{"sa-east-1": "http://foobar.com?region=sa-east"},
+	}
 
-			client := func(l *Latency) {
-				l.Client = httpClient
-			}
+	t.Run("should pick the custom region because it is the fastest", func(t *testing.T) {
+		os.Setenv("AWS_REGION", "")
+		l, _ := NewLatencyRouter(endpoints, client)
+		l.findLowLatencyEndpoint(context.Background())
+		if !strings.Contains(l.GetURL(), "sa-east") {
+			t.Fatalf("Latency.findLowLatencyEndpoint() got %s wanted an endpoint containing %s", l.GetURL(), "sa-east")
+		}
+	})
 
-			endpoints := EndPoints{
-				AsiaPacific: "http://foobar.com?region=apac",
-				Europe:      "http://foobar.com?region=eu",
-				Universal:   "http://foobar.com?region=universal",
-				USEast:      "http://foobar.com?region=us-east",
-				USWest:      "http://foobar.com?region=us-west",
-				Fallback:    "http://foobar.com?region=fallback",
-			}
+	t.Run("should pick the custom region because AWS_REGION matches it", func(t *testing.T) {
+		os.Setenv("AWS_REGION", "sa-east-1")
+		defer os.Setenv("AWS_REGION", "")
+		l, _ := NewLatencyRouter(endpoints, client)
+		if !strings.Contains(l.GetURL(), "sa-east") {
+			t.Fatalf("Latency.GetURL() got %s wanted an endpoint containing %s", l.GetURL(), "sa-east")
+		}
+	})
+}
 
-			if tt.args.useFallback {
-				endpoints = EndPoints{
-					Fallback: "http://foobar.com?region=fallback",
-				}
-			}
+func TestLatency_GetURLFallbacks(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.String(), "fallback-3") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
 
-			refresh := func(l *Latency) {
-				l.PingInterval = 500 * time.Millisecond
-			}
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
 
-			l, _ := NewLatencyRouter(endpoints, client, refresh)
-			l.StopPingingEndpoints()
-			time.Sleep(2500 * time.Millisecond)
+	endpoints := EndPoints{
+		USEast:    "http://foobar.com?region=us-east",
+		Fallback:  "http://foobar.com?region=fallback",
+		Fallbacks: []string{"http://foobar.com?region=fallback-2", "http://foobar.com?region=fallback-3"},
+	}
 
-			if !strings.Contains(l.GetURL(), tt.args.currentLocal) {
-				t.Fatalf("Latency.findLowLatencyEndpoint() got %s wanted an endpoint containing %s", l.FastestURL, tt.args.currentLocal)
-			}
+	l, _ := NewLatencyRouter(endpoints, func(l *Latency) {
+		l.Client = httpClient
+	})
+	if got := l.GetURL(); got != endpoints.Fallback {
+		t.Fatalf("Latency.GetURL() got %s wanted %s without health data", got, endpoints.Fallback)
+	}
 
-		})
+	l.findLowLatencyEndpoint(context.Background())
+	if got := l.GetURL(); got != endpoints.Fallbacks[1] {
+		t.Fatalf("Latency.GetURL() got %s wanted the first healthy fallback %s", got, endpoints.Fallbacks[1])
+	}
+	if err := l.LastError(); errors.Cause(err) != ErrAllEndpointsFailed {
+		t.Fatalf("Latency.LastError() got %v wanted %v, fallbacks are never selected", err, ErrAllEndpointsFailed)
 	}
 }
 
-func TestResourcesAreReleased(t *testing.T) {
-	defer goleak.VerifyNone(t)
+func TestLatency_GetLatencies(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
 	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.String(), "eu") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 	})
 
@@ -407,24 +562,2325 @@ func TestResourcesAreReleased(t *testing.T) {
 		l.Client = httpClient
 	}
 
-	endpoints := EndPoints{
-		AsiaPacific: "http://foobar.com?region=apac",
-		Europe:      "http://foobar.com?region=eu",
-		Universal:   "http://foobar.com?region=universal",
-		USEast:      "http://foobar.com?region=us-east",
-		USWest:      "http://foobar.com?region=us-west",
-		Fallback:    "http://foobar.com?region=fallback",
+	l, _ := NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, client)
+
+	if got := l.GetLatencies(); len(got) != 0 {
+		t.Fatalf("Latency.GetLatencies() got %v before any probe, wanted an empty map", got)
 	}
 
-	refresh := func(l *Latency) {
-		l.PingInterval = 500 * time.Millisecond
+	l.findLowLatencyEndpoint(context.Background())
+	got := l.GetLatencies()
+	if len(got) != 2 {
+		t.Fatalf("Latency.GetLatencies() got %d latencies wanted 2", len(got))
+	}
+	if got[l.Europe] != time.Hour {
+		t.Fatalf("Latency.GetLatencies() got %v for the failing endpoint wanted %v", got[l.Europe], time.Hour)
+	}
+	if got[l.USEast] >= time.Hour {
+		t.Fatalf("Latency.GetLatencies() got %v for the healthy endpoint wanted less than %v", got[l.USEast], time.Hour)
 	}
+}
 
-	for i := 0; i < 10; i++ {
-		l, _ := NewLatencyRouter(endpoints, client, refresh)
-		l.StopPingingEndpoints()
+func TestLatency_IsHealthy(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.String(), "eu") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	l, _ := NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, func(l *Latency) {
+		l.Client = httpClient
+	})
+
+	if l.IsHealthy(l.USEast) {
+		t.Fatal("Latency.IsHealthy() got true before any probe wanted false")
 	}
-	time.Sleep(1000 * time.Millisecond)
+
+	l.findLowLatencyEndpoint(context.Background())
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{url: l.USEast, want: true},
+		{url: l.Europe, want: false},
+		{url: l.Fallback, want: false},
+	}
+	for _, tt := range tests {
+		if got := l.IsHealthy(tt.url); got != tt.want {
+			t.Fatalf("Latency.IsHealthy(%s) got %v wanted %v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestWithProbeMethod(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Write([]byte("pong"))
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	endpoints := EndPoints{
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	l, _ := NewLatencyRouter(endpoints, client)
+	l.findLowLatencyEndpoint(context.Background())
+	if got := l.GetLatencies()[endpoints.USEast]; got != time.Hour {
+		t.Fatalf("HEAD probe got %v wanted %v", got, time.Hour)
+	}
+
+	l, _ = NewLatencyRouter(endpoints, client, WithProbeMethod("get"))
+	l.findLowLatencyEndpoint(context.Background())
+	if got := l.GetURL(); got != endpoints.USEast {
+		t.Fatalf("GET probe got %s wanted %s", got, endpoints.USEast)
+	}
+}
+
+func TestWithOnChange(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.String(), "us-east") {
+			time.Sleep(20 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	var l *Latency
+	var changes [][2]string
+	onChange := WithOnChange(func(oldURL, newURL string) {
+		// calling back into the router must not dead lock
+		changes = append(changes, [2]string{oldURL, l.GetURL()})
+	})
+
+	l, _ = NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, client, onChange)
+
+	l.findLowLatencyEndpoint(context.Background())
+	l.findLowLatencyEndpoint(context.Background())
+
+	if len(changes) != 1 {
+		t.Fatalf("WithOnChange() got %d calls wanted 1", len(changes))
+	}
+	if changes[0][0] != "" || changes[0][1] != l.USEast {
+		t.Fatalf("WithOnChange() got %v wanted [ %s]", changes[0], l.USEast)
+	}
+}
+
+func TestWithStickyThreshold(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	var fastRegion atomic.Value
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.String(), fastRegion.Load().(string)) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		want      string
+	}{
+		{
+			name: "should switch to eu without a threshold",
+			want: endpoints.Europe,
+		},
+		{
+			name:      "should stay on us-east because eu is within the threshold",
+			threshold: time.Second,
+			want:      endpoints.USEast,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _ := NewLatencyRouter(endpoints, client, WithStickyThreshold(tt.threshold))
+			fastRegion.Store("us-east")
+			l.findLowLatencyEndpoint(context.Background())
+			fastRegion.Store("eu")
+			l.findLowLatencyEndpoint(context.Background())
+			if got := l.GetURL(); got != tt.want {
+				t.Fatalf("Latency.GetURL() got %s wanted %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithProbeRetries(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	var requests int32
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first request always fails
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	endpoints := EndPoints{
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	l, _ := NewLatencyRouter(endpoints, client, WithProbeRetries(3, 10*time.Millisecond))
+	l.findLowLatencyEndpoint(context.Background())
+	if got := l.GetLatencies()[endpoints.USEast]; got >= time.Hour {
+		t.Fatalf("Latency.GetLatencies() got %v wanted a successful retry", got)
+	}
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Fatalf("WithProbeRetries() got %d requests wanted 2", got)
+	}
+}
+
+func TestLatency_SetOverride(t *testing.T) {
+	os.Setenv("AWS_REGION", "us-east-1")
+	defer os.Setenv("AWS_REGION", "")
+
+	l, _ := NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	})
+
+	l.SetOverride(l.Europe)
+	if got := l.GetURL(); got != l.Europe {
+		t.Fatalf("Latency.GetURL() got %s wanted the override %s", got, l.Europe)
+	}
+
+	l.ClearOverride()
+	if got := l.GetURL(); got != l.USEast {
+		t.Fatalf("Latency.GetURL() got %s wanted %s after clearing the override", got, l.USEast)
+	}
+}
+
+func TestWithEndpointTimeouts(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.String(), "apac") {
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+	httpClient.Timeout = 50 * time.Millisecond
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	endpoints := EndPoints{
+		AsiaPacific: "http://foobar.com?region=apac",
+		USEast:      "http://foobar.com?region=us-east",
+		Fallback:    "http://foobar.com?region=fallback",
+	}
+
+	l, _ := NewLatencyRouter(endpoints, client)
+	l.findLowLatencyEndpoint(context.Background())
+	if got := l.GetLatencies()[endpoints.AsiaPacific]; got != time.Hour {
+		t.Fatalf("Latency.GetLatencies() got %v wanted apac to time out", got)
+	}
+
+	timeouts := WithEndpointTimeouts(map[string]time.Duration{endpoints.AsiaPacific: time.Second})
+	l, _ = NewLatencyRouter(endpoints, client, timeouts)
+	l.findLowLatencyEndpoint(context.Background())
+	if got := l.GetLatencies()[endpoints.AsiaPacific]; got >= time.Hour {
+		t.Fatalf("Latency.GetLatencies() got %v wanted apac to be measured", got)
+	}
+	if httpClient.Timeout != 50*time.Millisecond {
+		t.Fatal("the user's client should not be modified")
+	}
+}
+
+func TestWithOnAllFailed(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	tests := []struct {
+		name      string
+		endpoints EndPoints
+		wantCalls int
+		wantErr   error
+	}{
+		{
+			name: "should call the hook when every endpoint fails",
+			endpoints: EndPoints{
+				Europe:   "http://foobar.com?region=eu",
+				USEast:   "http://foobar.com?region=us-east",
+				Fallback: "http://foobar.com?region=fallback",
+			},
+			wantCalls: 1,
+			wantErr:   ErrAllEndpointsFailed,
+		},
+		{
+			name: "should not call the hook when there is nothing to probe",
+			endpoints: EndPoints{
+				Fallback: "http://foobar.com?region=fallback",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			l, _ := NewLatencyRouter(tt.endpoints, client, WithOnAllFailed(func() { calls++ }))
+			l.findLowLatencyEndpoint(context.Background())
+			if calls != tt.wantCalls {
+				t.Fatalf("WithOnAllFailed() got %d calls wanted %d", calls, tt.wantCalls)
+			}
+			if err := l.LastError(); err != tt.wantErr {
+				t.Fatalf("Latency.LastError() got %v wanted %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWithTCPProbe(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	endpoints := EndPoints{
+		USEast:   "http://" + listener.Addr().String(),
+		USWest:   "http://" + closed.Addr().String(),
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	l, _ := NewLatencyRouter(endpoints, WithTCPProbe())
+	l.findLowLatencyEndpoint(context.Background())
+
+	latencies := l.GetLatencies()
+	if latencies[endpoints.USEast] >= time.Hour {
+		t.Fatalf("Latency.GetLatencies() got %v wanted the listening endpoint to be measured", latencies[endpoints.USEast])
+	}
+	if latencies[endpoints.USWest] != time.Hour {
+		t.Fatalf("Latency.GetLatencies() got %v wanted the closed endpoint to fail", latencies[endpoints.USWest])
+	}
+	if got := l.GetURL(); got != endpoints.USEast {
+		t.Fatalf("Latency.GetURL() got %s wanted %s", got, endpoints.USEast)
+	}
+
+	// the preset endpoint of the region is checked over TCP as well, an HTTP request would fail and trip the threshold
+	var probeErrors int32
+	l, _ = NewLatencyRouter(endpoints, WithTCPProbe(), WithRegionDetector(StaticRegionDetector("us-east-1")),
+		WithFailureThreshold(1, time.Hour), WithOnProbeError(func(string, error) {
+			atomic.AddInt32(&probeErrors, 1)
+		}))
+	l.findLowLatencyEndpoint(context.Background())
+	l.findLowLatencyEndpoint(context.Background())
+	if got := atomic.LoadInt32(&probeErrors); got != 0 {
+		t.Fatalf("WithOnProbeError() called %d times wanted the preset endpoint to pass its TCP check", got)
+	}
+	if got := l.GetURL(); got != endpoints.USEast || !l.IsHealthy(got) {
+		t.Fatalf("Latency.GetURL() got %s wanted the healthy preset %s", got, endpoints.USEast)
+	}
+}
+
+func TestWithPingJitter(t *testing.T) {
+	l := &Latency{PingInterval: time.Second}
+	WithPingJitter(0.1)(l)
+
+	for i := 0; i < 100; i++ {
+		if got := l.nextPingInterval(0); got < 900*time.Millisecond || got > 1100*time.Millisecond {
+			t.Fatalf("Latency.nextPingInterval() got %v wanted it within 10%% of %v", got, l.PingInterval)
+		}
+	}
+
+	l = &Latency{PingInterval: time.Second}
+	WithPingJitter(0)(l)
+	if got := l.nextPingInterval(0); got != time.Second {
+		t.Fatalf("Latency.nextPingInterval() got %v wanted %v without jitter", got, time.Second)
+	}
+}
+
+func TestWithFailureBackoff(t *testing.T) {
+	l := &Latency{PingInterval: time.Second}
+	WithFailureBackoff(5 * time.Second)(l)
+
+	tests := []struct {
+		failedChecks int
+		want         time.Duration
+	}{
+		{failedChecks: 0, want: time.Second},
+		{failedChecks: 1, want: 2 * time.Second},
+		{failedChecks: 2, want: 4 * time.Second},
+		{failedChecks: 3, want: 5 * time.Second},
+		{failedChecks: 100, want: 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := l.nextPingInterval(tt.failedChecks); got != tt.want {
+			t.Fatalf("Latency.nextPingInterval(%d) got %v wanted %v", tt.failedChecks, got, tt.want)
+		}
+	}
+}
+
+func TestWithFailureBackoffRecovers(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	os.Setenv("AWS_REGION", "")
+	var probes int32
+	var down atomic.Value
+	down.Store(true)
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		atomic.AddInt32(&probes, 1)
+		if down.Load().(bool) {
+			return 0, ErrTimeout
+		}
+		return time.Millisecond, nil
+	})
+
+	l, _ := NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, probe, WithCustomPingInterval(10*time.Millisecond), WithFailureBackoff(80*time.Millisecond))
+	defer l.Close()
+
+	// checks run at 0, 20, 60, 140 and 220ms while everything is down, without the backoff it would be over 20 checks
+	time.Sleep(250 * time.Millisecond)
+	if got := atomic.LoadInt32(&probes) / 2; got > 8 {
+		t.Fatalf("ran %d checks while all endpoints failed wanted them to back off", got)
+	}
+
+	down.Store(false)
+	time.Sleep(100 * time.Millisecond)
+	before := atomic.LoadInt32(&probes)
+	time.Sleep(100 * time.Millisecond)
+	if got := (atomic.LoadInt32(&probes) - before) / 2; got < 4 {
+		t.Fatalf("ran %d checks in 100ms after recovering wanted the interval to reset", got)
+	}
+}
+
+func TestLatency_RefreshNow(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.String(), "eu") {
+			time.Sleep(10 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	refresh := func(l *Latency) {
+		l.PingInterval = 20 * time.Millisecond
+	}
+
+	l, _ := NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, client, refresh)
+	defer l.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.RefreshNow(context.Background()); err != nil {
+				t.Errorf("Latency.RefreshNow() unexpected error %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := l.GetURL(); got != l.Europe {
+		t.Fatalf("Latency.GetURL() got %s wanted %s", got, l.Europe)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.RefreshNow(ctx); err != context.Canceled {
+		t.Fatalf("Latency.RefreshNow() got %v wanted %v", err, context.Canceled)
+	}
+}
+
+func TestWithFailureThreshold(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	var euHealthy int32
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.String(), "eu") {
+			time.Sleep(10 * time.Millisecond)
+		} else if atomic.LoadInt32(&euHealthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	l, _ := NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, client, WithFailureThreshold(2, time.Hour))
+
+	l.findLowLatencyEndpoint(context.Background())
+	l.findLowLatencyEndpoint(context.Background())
+	atomic.StoreInt32(&euHealthy, 1)
+	l.findLowLatencyEndpoint(context.Background())
+
+	if got := l.GetURL(); got != l.USEast {
+		t.Fatalf("Latency.GetURL() got %s wanted %s while eu is cooling down", got, l.USEast)
+	}
+	if _, ok := l.Stats().BrokenUntil[l.Europe]; !ok {
+		t.Fatalf("Latency.Stats() BrokenUntil got %v wanted %s", l.Stats().BrokenUntil, l.Europe)
+	}
+	if got := l.Stats().ConsecutiveFailures[l.Europe]; got != 0 {
+		t.Fatalf("Latency.Stats() ConsecutiveFailures got %d wanted the counter to reset", got)
+	}
+}
+
+func TestWithSelector(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.String(), "apac") {
+			time.Sleep(10 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	endpoints := EndPoints{
+		AsiaPacific: "http://foobar.com?region=apac",
+		USEast:      "http://foobar.com?region=us-east",
+		Fallback:    "http://foobar.com?region=fallback",
+	}
+
+	var got []LatencyResult
+	// apac is expensive, so it only wins when it's a full second faster
+	selector := WithSelector(func(results []LatencyResult) string {
+		got = results
+		var apac, usEast time.Duration
+		for _, result := range results {
+			switch result.URL {
+			case endpoints.AsiaPacific:
+				apac = result.Duration
+			case endpoints.USEast:
+				usEast = result.Duration
+			}
+		}
+		if apac+time.Second < usEast {
+			return endpoints.AsiaPacific
+		}
+		return endpoints.USEast
+	})
+
+	l, _ := NewLatencyRouter(endpoints, client, selector)
+	l.findLowLatencyEndpoint(context.Background())
+
+	if len(got) != 2 {
+		t.Fatalf("WithSelector() got %d results wanted 2", len(got))
+	}
+	if url := l.GetURL(); url != endpoints.USEast {
+		t.Fatalf("Latency.GetURL() got %s wanted %s", url, endpoints.USEast)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	var euRequests int32
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.String(), "eu") {
+			atomic.AddInt32(&euRequests, 1)
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	l, _ := NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, client, WithProbeRetries(3, 0))
+
+	l.findLowLatencyEndpoint(context.Background())
+	l.findLowLatencyEndpoint(context.Background())
+
+	if got := atomic.LoadInt32(&euRequests); got != 1 {
+		t.Fatalf("eu got %d requests wanted 1, it asked to be left alone", got)
+	}
+	if until, ok := l.Stats().BackoffUntil[l.Europe]; !ok || until.Before(time.Now().Add(time.Minute)) {
+		t.Fatalf("Latency.Stats() BackoffUntil got %v wanted about two minutes from now", until)
+	}
+
+	// the preset endpoint of the region gets a single request as well
+	atomic.StoreInt32(&euRequests, 0)
+	l, _ = NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, client, WithRegionDetector(StaticRegionDetector("eu-west-1")))
+
+	l.findLowLatencyEndpoint(context.Background())
+	l.findLowLatencyEndpoint(context.Background())
+
+	if got := atomic.LoadInt32(&euRequests); got != 1 {
+		t.Fatalf("the preset eu got %d requests wanted 1, it asked to be left alone", got)
+	}
+	if got := l.GetURL(); got != l.USEast {
+		t.Fatalf("Latency.GetURL() got %s wanted %s while eu backs off", got, l.USEast)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		value  string
+		want   time.Time
+		wantOK bool
+	}{
+		{
+			name:   "should parse seconds",
+			value:  "30",
+			want:   now.Add(30 * time.Second),
+			wantOK: true,
+		},
+		{
+			name:   "should parse an http date",
+			value:  "Fri, 01 May 2020 12:05:00 GMT",
+			want:   now.Add(5 * time.Minute),
+			wantOK: true,
+		},
+		{
+			name:  "should ignore garbage",
+			value: "soon",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.value, now)
+			if ok != tt.wantOK || !got.Equal(tt.want) {
+				t.Fatalf("parseRetryAfter() got %v, %v wanted %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestWithAcceptableStatus(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.String(), "us-east"):
+			w.WriteHeader(http.StatusNoContent)
+		case strings.Contains(r.URL.String(), "eu"):
+			w.WriteHeader(http.StatusPartialContent)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	tests := []struct {
+		name        string
+		options     []func(*Latency)
+		wantFailure bool
+	}{
+		{
+			name:    "should accept 204 and 206 by default",
+			options: []func(*Latency){client},
+		},
+		{
+			name: "should reject 204 and 206 with a strict check",
+			options: []func(*Latency){client, WithAcceptableStatus(func(code int) bool {
+				return code == http.StatusOK
+			})},
+			wantFailure: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _ := NewLatencyRouter(endpoints, tt.options...)
+			l.findLowLatencyEndpoint(context.Background())
+			latencies := l.GetLatencies()
+			for _, endpoint := range []string{endpoints.USEast, endpoints.Europe} {
+				if failed := latencies[endpoint] == time.Hour; failed != tt.wantFailure {
+					t.Fatalf("probe of %s failed = %v wanted %v", endpoint, failed, tt.wantFailure)
+				}
+			}
+		})
+	}
+}
+
+func TestWithPerEndpointStatus(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.String(), "us-east"):
+			w.WriteHeader(http.StatusNoContent)
+		case strings.Contains(r.URL.String(), "us-west"):
+			w.WriteHeader(http.StatusMovedPermanently)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		USWest:   "http://foobar.com?region=us-west",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+	only := func(want int) func(int) bool {
+		return func(code int) bool {
+			return code == want
+		}
+	}
+
+	tests := []struct {
+		name        string
+		options     []func(*Latency)
+		wantHealthy map[string]bool
+	}{
+		{
+			name: "should use each endpoint's own check",
+			options: []func(*Latency){client, WithPerEndpointStatus(map[string]func(int) bool{
+				endpoints.USEast: only(http.StatusNoContent),
+				endpoints.USWest: only(http.StatusMovedPermanently),
+			}), WithAcceptableStatus(only(http.StatusOK))},
+			wantHealthy: map[string]bool{endpoints.Europe: true, endpoints.USEast: true, endpoints.USWest: true},
+		},
+		{
+			name: "should fall back to the global check for the other endpoints",
+			options: []func(*Latency){client, WithPerEndpointStatus(map[string]func(int) bool{
+				endpoints.USWest: only(http.StatusMovedPermanently),
+			}), WithAcceptableStatus(only(http.StatusOK))},
+			wantHealthy: map[string]bool{endpoints.Europe: true, endpoints.USEast: false, endpoints.USWest: true},
+		},
+		{
+			name: "should let an endpoint be stricter than the default",
+			options: []func(*Latency){client, WithPerEndpointStatus(map[string]func(int) bool{
+				endpoints.Europe: only(http.StatusNoContent),
+			})},
+			wantHealthy: map[string]bool{endpoints.Europe: false, endpoints.USEast: true, endpoints.USWest: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _ := NewLatencyRouter(endpoints, tt.options...)
+			l.findLowLatencyEndpoint(context.Background())
+			for endpoint, want := range tt.wantHealthy {
+				if got := l.IsHealthy(endpoint); got != want {
+					t.Fatalf("Latency.IsHealthy(%s) got %v wanted %v", endpoint, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWithBlockUntilReady(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.String(), "eu") {
+			time.Sleep(20 * time.Millisecond)
+		}
+		if strings.Contains(r.URL.String(), "apac") {
+			time.Sleep(500 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	tests := []struct {
+		name    string
+		options []func(*Latency)
+	}{
+		{
+			name:    "should select an endpoint before returning without a ping interval",
+			options: []func(*Latency){client, WithBlockUntilReady(time.Second)},
+		},
+		{
+			name:    "should wait for the ping goroutine's first check",
+			options: []func(*Latency){client, WithBlockUntilReady(time.Second), func(l *Latency) { l.PingInterval = time.Minute }},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _ := NewLatencyRouter(endpoints, tt.options...)
+			defer l.Close()
+			if got := l.GetURL(); got != endpoints.USEast {
+				t.Fatalf("Latency.GetURL() got %s wanted %s right after construction", got, endpoints.USEast)
+			}
+		})
+	}
+
+	t.Run("should return once the timeout fires", func(t *testing.T) {
+		slow := EndPoints{
+			AsiaPacific: "http://foobar.com?region=apac",
+			Fallback:    "http://foobar.com?region=fallback",
+		}
+		start := time.Now()
+		l, _ := NewLatencyRouter(slow, client, WithBlockUntilReady(50*time.Millisecond))
+		if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+			t.Fatalf("NewLatencyRouter() took %v wanted it to give up after the timeout", elapsed)
+		}
+		if got := l.GetURL(); got != slow.Fallback {
+			t.Fatalf("Latency.GetURL() got %s wanted %s", got, slow.Fallback)
+		}
+	})
+
+	t.Run("should not check again after the check made during construction", func(t *testing.T) {
+		var probes int32
+		probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+			atomic.AddInt32(&probes, 1)
+			return time.Millisecond, nil
+		})
+		NewLatencyRouter(endpoints, probe, WithCustomPingInterval(0), WithBlockUntilReady(time.Second))
+		if got := atomic.LoadInt32(&probes); got != 2 {
+			t.Fatalf("probed %d times wanted a single check", got)
+		}
+	})
+}
+
+func TestWithAlwaysProbeAll(t *testing.T) {
+	os.Setenv("AWS_REGION", "us-east-1")
+	defer os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.String(), "us-east") {
+			time.Sleep(20 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	tests := []struct {
+		name     string
+		probeAll bool
+		want     string
+	}{
+		{
+			name: "should keep the healthy preset endpoint",
+			want: endpoints.USEast,
+		},
+		{
+			name:     "should pick a faster endpoint over the preset one",
+			probeAll: true,
+			want:     endpoints.Europe,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _ := NewLatencyRouter(endpoints, client, WithAlwaysProbeAll(tt.probeAll))
+			l.findLowLatencyEndpoint(context.Background())
+			if got := l.GetURL(); got != tt.want {
+				t.Fatalf("Latency.GetURL() got %s wanted %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetDefaultClient(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	endpoints := EndPoints{
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	before, _ := NewLatencyRouter(endpoints)
+	SetDefaultClient(httpClient)
+	defer SetDefaultClient(nil)
+
+	l, _ := NewLatencyRouter(endpoints)
+	l.findLowLatencyEndpoint(context.Background())
+	if got := l.GetURL(); got != endpoints.USEast {
+		t.Fatalf("Latency.GetURL() got %s wanted %s", got, endpoints.USEast)
+	}
+	if before.Client.Transport == httpClient.Transport {
+		t.Fatal("routers constructed before SetDefaultClient should keep their client")
+	}
+
+	SetDefaultClient(nil)
+	l, _ = NewLatencyRouter(endpoints)
+	if l.Client.Transport != defaultClient.Transport {
+		t.Fatal("SetDefaultClient(nil) should restore the built in client")
+	}
+}
+
+func TestWithProbeFunc(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	endpoints := EndPoints{
+		AsiaPacific: "http://foobar.com?region=apac",
+		Europe:      "http://foobar.com?region=eu",
+		USEast:      "http://foobar.com?region=us-east",
+		Fallback:    "http://foobar.com?region=fallback",
+	}
+
+	latencies := map[string]time.Duration{
+		endpoints.AsiaPacific: 30 * time.Millisecond,
+		endpoints.Europe:      10 * time.Millisecond,
+	}
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		if latency, ok := latencies[url]; ok {
+			return latency, nil
+		}
+		return 0, ErrTimeout
+	})
+
+	l, _ := NewLatencyRouter(endpoints, probe)
+	l.findLowLatencyEndpoint(context.Background())
+	if got := l.GetURL(); got != endpoints.Europe {
+		t.Fatalf("Latency.GetURL() got %s wanted %s", got, endpoints.Europe)
+	}
+
+	want := map[string]time.Duration{
+		endpoints.AsiaPacific: 30 * time.Millisecond,
+		endpoints.Europe:      10 * time.Millisecond,
+		endpoints.USEast:      time.Hour,
+	}
+	if got := l.GetLatencies(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Latency.GetLatencies() got %v wanted %v", got, want)
+	}
+
+	// the preset endpoint of the region records the injected latency as well
+	l, _ = NewLatencyRouter(endpoints, probe, WithRegionDetector(StaticRegionDetector("ap-southeast-1")))
+	l.findLowLatencyEndpoint(context.Background())
+	if got := l.GetLatencies()[endpoints.AsiaPacific]; got != 30*time.Millisecond {
+		t.Fatalf("Latency.GetLatencies() got %v for the preset endpoint wanted %v", got, 30*time.Millisecond)
+	}
+}
+
+func TestWithRegionalPreference(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	endpoints := EndPoints{
+		Universal: "http://foobar.com?region=universal",
+		Europe:    "http://foobar.com?region=eu",
+		USEast:    "http://foobar.com?region=us-east",
+		Fallback:  "http://foobar.com?region=fallback",
+	}
+
+	probe := func(latencies map[string]time.Duration) func(*Latency) {
+		return WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+			return latencies[url], nil
+		})
+	}
+
+	tests := []struct {
+		name      string
+		latencies map[string]time.Duration
+		bias      time.Duration
+		want      string
+	}{
+		{
+			name:      "should pick universal without a bias",
+			latencies: map[string]time.Duration{endpoints.Universal: 9 * time.Millisecond, endpoints.Europe: 10 * time.Millisecond, endpoints.USEast: 30 * time.Millisecond},
+			want:      endpoints.Universal,
+		},
+		{
+			name:      "should pick the region when universal is faster by less than the bias",
+			latencies: map[string]time.Duration{endpoints.Universal: 9 * time.Millisecond, endpoints.Europe: 10 * time.Millisecond, endpoints.USEast: 30 * time.Millisecond},
+			bias:      5 * time.Millisecond,
+			want:      endpoints.Europe,
+		},
+		{
+			name:      "should pick universal when it's clearly faster",
+			latencies: map[string]time.Duration{endpoints.Universal: 2 * time.Millisecond, endpoints.Europe: 10 * time.Millisecond, endpoints.USEast: 30 * time.Millisecond},
+			bias:      5 * time.Millisecond,
+			want:      endpoints.Universal,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _ := NewLatencyRouter(endpoints, probe(tt.latencies), WithRegionalPreference(tt.bias))
+			l.findLowLatencyEndpoint(context.Background())
+			if got := l.GetURL(); got != tt.want {
+				t.Fatalf("Latency.GetURL() got %s wanted %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewLatencyRouterInsufficientEndpoints(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	refresh := func(l *Latency) {
+		l.PingInterval = time.Minute
+	}
+
+	tests := []struct {
+		name      string
+		endpoints EndPoints
+		options   []func(*Latency)
+		wantErr   error
+	}{
+		{
+			name:      "should refuse latency routing with only universal",
+			endpoints: EndPoints{Universal: "http://foobar.com?region=universal"},
+			options:   []func(*Latency){refresh},
+			wantErr:   ErrInsufficientEndpointsForLatency,
+		},
+		{
+			name:      "should refuse latency routing when the fallback shares the only endpoint",
+			endpoints: EndPoints{USEast: "http://foobar.com?region=us-east", Fallback: "http://foobar.com?region=us-east"},
+			options:   []func(*Latency){refresh},
+			wantErr:   ErrInsufficientEndpointsForLatency,
+		},
+		{
+			name:      "should refuse latency routing with a single region, the fallback is not a contender",
+			endpoints: EndPoints{Universal: "http://foobar.com?region=universal", Fallback: "http://foobar.com?region=fallback"},
+			options:   []func(*Latency){refresh},
+			wantErr:   ErrInsufficientEndpointsForLatency,
+		},
+		{
+			name:      "should allow latency routing against a fallback that is probed",
+			endpoints: EndPoints{Universal: "http://foobar.com?region=universal", Fallback: "http://foobar.com?region=fallback"},
+			options:   []func(*Latency){refresh, WithProbeFallback(true)},
+		},
+		{
+			name:      "should refuse latency routing when the other region is excluded",
+			endpoints: EndPoints{Europe: "http://foobar.com?region=eu", USEast: "http://foobar.com?region=us-east", Fallback: "http://foobar.com?region=fallback"},
+			options:   []func(*Latency){refresh, WithExcludeFromProbe("Europe")},
+			wantErr:   ErrInsufficientEndpointsForLatency,
+		},
+		{
+			name:      "should allow a single endpoint without latency routing",
+			endpoints: EndPoints{Universal: "http://foobar.com?region=universal"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewLatencyRouter(tt.endpoints, tt.options...)
+			if errors.Cause(err) != tt.wantErr {
+				t.Fatalf("NewLatencyRouter() error = %v wanted %v", err, tt.wantErr)
+			}
+			if err == nil {
+				l.Close()
+			}
+		})
+	}
+}
+
+func TestWithProbeHeaders(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.UserAgent() != "router-probe/1.0" || r.Header.Get("X-Api-Key") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	endpoints := EndPoints{
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	l, _ := NewLatencyRouter(endpoints, client)
+	l.findLowLatencyEndpoint(context.Background())
+	if l.IsHealthy(endpoints.USEast) {
+		t.Fatal("probe without headers succeeded wanted the WAF to block it")
+	}
+
+	header := http.Header{}
+	header.Set("User-Agent", "router-probe/1.0")
+	header.Set("X-Api-Key", "secret")
+	l, _ = NewLatencyRouter(endpoints, client, WithProbeHeaders(header))
+	header.Del("X-Api-Key")
+	l.findLowLatencyEndpoint(context.Background())
+	if !l.IsHealthy(endpoints.USEast) {
+		t.Fatal("probe with headers failed wanted them to reach the server")
+	}
+}
+
+func TestLatency_UpdateEndpoints(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		if strings.Contains(url, "eu") {
+			return 10 * time.Millisecond, nil
+		}
+		return 20 * time.Millisecond, nil
+	})
+
+	old := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+	l, _ := NewLatencyRouter(old, probe, WithRegionDetector(StaticRegionDetector("eu-west-1")), WithAlwaysProbeAll(true))
+	l.findLowLatencyEndpoint(context.Background())
+	if got := l.GetURL(); got != old.Europe {
+		t.Fatalf("Latency.GetURL() got %s wanted %s", got, old.Europe)
+	}
+
+	if err := l.UpdateEndpoints(EndPoints{Europe: "eu.foobar.com"}); err == nil {
+		t.Fatal("Latency.UpdateEndpoints() wanted an error for invalid endpoints")
+	}
+	stale := EndPoints{Europe: old.Europe, Fallback: old.Fallback, FastestURL: "http://foobar.com?region=decommissioned"}
+	if err := l.UpdateEndpoints(stale); errors.Cause(err) != ErrClosestURLMismatch {
+		t.Fatalf("Latency.UpdateEndpoints() error = %v wanted %v", err, ErrClosestURLMismatch)
+	}
+	if got := l.GetURL(); got != old.Europe {
+		t.Fatalf("Latency.GetURL() got %s wanted the endpoints to be kept after an invalid update", got)
+	}
+
+	updated := EndPoints{
+		Europe:   "http://foobar.com?region=eu-2",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+	if err := l.UpdateEndpoints(updated); err != nil {
+		t.Fatalf("Latency.UpdateEndpoints() error = %v", err)
+	}
+	if got := l.GetURL(); got != updated.Europe {
+		t.Fatalf("Latency.GetURL() got %s wanted %s", got, updated.Europe)
+	}
+	latencies := l.GetLatencies()
+	if _, ok := latencies[old.Europe]; ok {
+		t.Fatalf("Latency.GetLatencies() got %v wanted the removed endpoint to be dropped", latencies)
+	}
+	if _, ok := latencies[old.USEast]; !ok {
+		t.Fatalf("Latency.GetLatencies() got %v wanted the kept endpoint to remain", latencies)
+	}
+
+	l.findLowLatencyEndpoint(context.Background())
+	if !l.IsHealthy(updated.Europe) {
+		t.Fatal("the next latency check should probe the new endpoints")
+	}
+
+	// with latency routing the fallback doesn't count as a second endpoint to compare
+	l, _ = NewLatencyRouter(old, probe, WithCustomPingInterval(time.Hour))
+	defer l.Close()
+	single := EndPoints{Universal: "http://foobar.com?region=universal", Fallback: old.Fallback}
+	if err := l.UpdateEndpoints(single); errors.Cause(err) != ErrInsufficientEndpointsForLatency {
+		t.Fatalf("Latency.UpdateEndpoints() error = %v wanted %v", err, ErrInsufficientEndpointsForLatency)
+	}
+}
+
+func TestLatency_UpdateEndpointsConcurrently(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		return time.Millisecond, nil
+	})
+	sets := []EndPoints{
+		{Europe: "http://foobar.com?region=eu", Fallback: "http://foobar.com?region=fallback"},
+		{USEast: "http://foobar.com?region=us-east", Fallback: "http://foobar.com?region=fallback"},
+	}
+
+	l, _ := NewLatencyRouter(sets[0], probe)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				switch i {
+				case 0:
+					l.UpdateEndpoints(sets[j%2])
+				case 1:
+					l.findLowLatencyEndpoint(context.Background())
+				default:
+					l.GetURL()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestNewStaticRouter(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	os.Setenv("AWS_REGION", "eu-west-1")
+	defer os.Setenv("AWS_REGION", "")
+
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	l, err := NewStaticRouter(endpoints, endpoints.USEast)
+	if err != nil {
+		t.Fatalf("NewStaticRouter() error = %v", err)
+	}
+	if got := l.GetURL(); got != endpoints.USEast {
+		t.Fatalf("Latency.GetURL() got %s wanted the preset %s", got, endpoints.USEast)
+	}
+
+	if _, err := NewStaticRouter(endpoints, "http://decommissioned.foobar.com"); errors.Cause(err) != ErrClosestURLMismatch {
+		t.Fatalf("NewStaticRouter() error = %v wanted %v", err, ErrClosestURLMismatch)
+	}
+	if _, err := NewStaticRouter(endpoints, "us-east.foobar.com"); errors.Cause(err) != ErrMissingProtocol {
+		t.Fatalf("NewStaticRouter() error = %v wanted %v", err, ErrMissingProtocol)
+	}
+}
+
+func TestWithCustomPingInterval(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	os.Setenv("AWS_REGION", "")
+	var probes int32
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		atomic.AddInt32(&probes, 1)
+		if strings.Contains(url, "eu") {
+			return 10 * time.Millisecond, nil
+		}
+		return 20 * time.Millisecond, nil
+	})
+
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	l, _ := NewLatencyRouter(endpoints, probe, WithCustomPingInterval(0))
+	if got := l.GetURL(); got != endpoints.Europe {
+		t.Fatalf("Latency.GetURL() got %s wanted %s after the single check", got, endpoints.Europe)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt32(&probes); got != 2 {
+		t.Fatalf("probed %d times wanted a single check of 2 endpoints", got)
+	}
+}
+
+func TestLatency_findLowLatencyEndpointZones(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	latencies := map[string]time.Duration{
+		"http://foobar.com?region=eu-a":    30 * time.Millisecond,
+		"http://foobar.com?region=eu-b":    10 * time.Millisecond,
+		"http://foobar.com?region=us-east": 20 * time.Millisecond,
+	}
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		if latency, ok := latencies[url]; ok {
+			return latency, nil
+		}
+		return 0, ErrTimeout
+	})
+
+	l, err := NewLatencyRouter(EndPoints{
+		Europe:      "http://foobar.com?region=eu-a",
+		EuropeZones: []string{"http://foobar.com?region=eu-b"},
+		USEast:      "http://foobar.com?region=us-east",
+		Fallback:    "http://foobar.com?region=fallback",
+	}, probe)
+	if err != nil {
+		t.Fatalf("NewLatencyRouter() error = %v", err)
+	}
+
+	l.findLowLatencyEndpoint(context.Background())
+	url, region := l.GetURLWithRegion()
+	if url != "http://foobar.com?region=eu-b" || region != "europe" {
+		t.Fatalf("Latency.GetURLWithRegion() got %s, %s wanted the fastest availability zone of europe", url, region)
+	}
+	if got := len(l.GetLatencies()); got != 3 {
+		t.Fatalf("Latency.GetLatencies() got %d latencies wanted every url to be probed", got)
+	}
+}
+
+func TestWithExcludeFromProbe(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	endpoints := EndPoints{
+		Universal: "http://foobar.com?region=universal",
+		Europe:    "http://foobar.com?region=eu",
+		USEast:    "http://foobar.com?region=us-east",
+		Fallback:  "http://foobar.com?region=fallback",
+	}
+
+	var mu sync.Mutex
+	probed := make(map[string]bool)
+	var down atomic.Value
+	down.Store(false)
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		mu.Lock()
+		probed[url] = true
+		mu.Unlock()
+		if url == endpoints.Universal {
+			return time.Millisecond, nil
+		}
+		if down.Load().(bool) {
+			return 0, ErrTimeout
+		}
+		if url == endpoints.Europe {
+			return 10 * time.Millisecond, nil
+		}
+		return 20 * time.Millisecond, nil
+	})
+
+	l, _ := NewLatencyRouter(endpoints, probe, WithExcludeFromProbe("Universal"))
+	l.findLowLatencyEndpoint(context.Background())
+	if got := l.GetURL(); got != endpoints.Europe {
+		t.Fatalf("Latency.GetURL() got %s wanted %s", got, endpoints.Europe)
+	}
+	if probed[endpoints.Universal] {
+		t.Fatal("the excluded endpoint should never be probed")
+	}
+
+	down.Store(true)
+	l, _ = NewLatencyRouter(endpoints, probe, WithExcludeFromProbe("Universal"))
+	l.findLowLatencyEndpoint(context.Background())
+	if got := l.GetURL(); got != endpoints.Universal {
+		t.Fatalf("Latency.GetURL() got %s wanted the excluded %s as the safety net", got, endpoints.Universal)
+	}
+}
+
+func TestWithReachabilityMode(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.String(), "us-east"):
+			w.WriteHeader(http.StatusUnauthorized)
+		case strings.Contains(r.URL.String(), "eu"):
+			// the connection is dropped without a response
+			panic(http.ErrAbortHandler)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	tests := []struct {
+		name        string
+		options     []func(*Latency)
+		wantHealthy map[string]bool
+	}{
+		{
+			name:        "should fail a 401 by default",
+			options:     []func(*Latency){client},
+			wantHealthy: map[string]bool{endpoints.USEast: false, endpoints.Europe: false},
+		},
+		{
+			name:        "should count a 401 as reachable but not a dropped connection",
+			options:     []func(*Latency){client, WithReachabilityMode()},
+			wantHealthy: map[string]bool{endpoints.USEast: true, endpoints.Europe: false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _ := NewLatencyRouter(endpoints, tt.options...)
+			l.findLowLatencyEndpoint(context.Background())
+			for endpoint, want := range tt.wantHealthy {
+				if got := l.IsHealthy(endpoint); got != want {
+					t.Fatalf("Latency.IsHealthy(%s) got %v wanted %v", endpoint, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWithMaxConcurrentProbes(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		USWest:   "http://foobar.com?region=us-west",
+		Fallback: "http://foobar.com?region=fallback",
+		CustomRegions: map[string]string{
+			"sa-east-1":    "http://foobar.com?region=sa-east",
+			"me-south-1":   "http://foobar.com?region=me-south",
+			"af-south-1":   "http://foobar.com?region=af-south",
+			"ap-east-1":    "http://foobar.com?region=ap-east",
+			"eu-central-2": "http://foobar.com?region=eu-central",
+		},
+	}
+
+	tests := []struct {
+		name    string
+		limit   int
+		wantMax int32
+	}{
+		{
+			name:    "should probe every endpoint at once by default",
+			wantMax: 8,
+		},
+		{
+			name:    "should probe at most two endpoints at a time",
+			limit:   2,
+			wantMax: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inFlight, maxInFlight int32
+			probe := WithProbeFunc(func(ctx context.Context, url string) (time.Duration, error) {
+				n := atomic.AddInt32(&inFlight, 1)
+				defer atomic.AddInt32(&inFlight, -1)
+				for {
+					max := atomic.LoadInt32(&maxInFlight)
+					if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+						break
+					}
+				}
+				select {
+				case <-time.After(50 * time.Millisecond):
+					return time.Millisecond, nil
+				case <-ctx.Done():
+					return 0, ctx.Err()
+				}
+			})
+
+			// with a limit of two the four rounds of probes take longer than the timeout, which only bounds each probe
+			client := func(l *Latency) {
+				l.Client = &http.Client{Timeout: 120 * time.Millisecond}
+			}
+			l, _ := NewLatencyRouter(endpoints, probe, client, WithMaxConcurrentProbes(tt.limit))
+			l.findLowLatencyEndpoint(context.Background())
+			if got := atomic.LoadInt32(&maxInFlight); got != tt.wantMax {
+				t.Fatalf("probed %d endpoints at once wanted %d", got, tt.wantMax)
+			}
+			latencies := l.GetLatencies()
+			if got := len(latencies); got != 8 {
+				t.Fatalf("Latency.GetLatencies() got %d latencies wanted every endpoint to be probed", got)
+			}
+			for url, d := range latencies {
+				if d == time.Hour {
+					t.Fatalf("Latency.GetLatencies() got %v for %s wanted waiting for a slot to not time the probe out", d, url)
+				}
+			}
+		})
+	}
+}
+
+func TestWithEndpointWeights(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		if url == endpoints.Europe {
+			return 10 * time.Millisecond, nil
+		}
+		return 15 * time.Millisecond, nil
+	})
+
+	tests := []struct {
+		name    string
+		weights map[string]float64
+		want    string
+		wantErr error
+	}{
+		{
+			name: "should pick the fastest without weights",
+			want: endpoints.Europe,
+		},
+		{
+			name:    "should pick the cheaper endpoint when the faster one is penalized",
+			weights: map[string]float64{endpoints.Europe: 2},
+			want:    endpoints.USEast,
+		},
+		{
+			name:    "should pick a favored endpoint",
+			weights: map[string]float64{endpoints.USEast: 0.5},
+			want:    endpoints.USEast,
+		},
+		{
+			name:    "should refuse a weight that isn't positive",
+			weights: map[string]float64{endpoints.USEast: 0},
+			wantErr: ErrInvalidWeight,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewLatencyRouter(endpoints, probe, WithEndpointWeights(tt.weights))
+			if errors.Cause(err) != tt.wantErr {
+				t.Fatalf("NewLatencyRouter() error = %v wanted %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			l.findLowLatencyEndpoint(context.Background())
+			if got := l.GetURL(); got != tt.want {
+				t.Fatalf("Latency.GetURL() got %s wanted %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithMinimumHealthySamples(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	var europeUp atomic.Value
+	europeUp.Store(true)
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		switch url {
+		case endpoints.Europe:
+			if !europeUp.Load().(bool) {
+				return 0, ErrTimeout
+			}
+			return 10 * time.Millisecond, nil
+		case endpoints.USEast:
+			return 20 * time.Millisecond, nil
+		}
+		return 0, ErrTimeout
+	})
+
+	l, _ := NewLatencyRouter(endpoints, probe, WithMinimumHealthySamples(3))
+	for i := 0; i < 2; i++ {
+		l.findLowLatencyEndpoint(context.Background())
+		if got := l.GetURL(); got != endpoints.Fallback {
+			t.Fatalf("Latency.GetURL() got %s after %d checks wanted %s", got, i+1, endpoints.Fallback)
+		}
+		if err := l.LastError(); err != nil {
+			t.Fatalf("Latency.LastError() got %v wanted nil while endpoints are being proven", err)
+		}
+	}
+
+	l.findLowLatencyEndpoint(context.Background())
+	if got := l.GetURL(); got != endpoints.Europe {
+		t.Fatalf("Latency.GetURL() got %s wanted %s after 3 healthy samples", got, endpoints.Europe)
+	}
+
+	// a flaky europe has to prove itself again, us-east stays selected meanwhile
+	europeUp.Store(false)
+	l.findLowLatencyEndpoint(context.Background())
+	europeUp.Store(true)
+	for i := 0; i < 2; i++ {
+		l.findLowLatencyEndpoint(context.Background())
+		if got := l.GetURL(); got != endpoints.USEast {
+			t.Fatalf("Latency.GetURL() got %s wanted %s while eu recovers", got, endpoints.USEast)
+		}
+	}
+	l.findLowLatencyEndpoint(context.Background())
+	if got := l.GetURL(); got != endpoints.Europe {
+		t.Fatalf("Latency.GetURL() got %s wanted %s once it recovered", got, endpoints.Europe)
+	}
+}
+
+func TestWithProbeFallback(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	endpoints := EndPoints{
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	var probed int32
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		if url == endpoints.Fallback {
+			atomic.AddInt32(&probed, 1)
+			return 5 * time.Millisecond, nil
+		}
+		return 50 * time.Millisecond, nil
+	})
+
+	tests := []struct {
+		name       string
+		probe      bool
+		want       string
+		wantProbes int32
+	}{
+		{
+			name: "should keep the fallback out of the contenders by default",
+			want: endpoints.USEast,
+		},
+		{
+			name:       "should select a faster fallback",
+			probe:      true,
+			want:       endpoints.Fallback,
+			wantProbes: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&probed, 0)
+			l, _ := NewLatencyRouter(endpoints, probe, WithProbeFallback(tt.probe))
+			l.findLowLatencyEndpoint(context.Background())
+			if got := l.GetURL(); got != tt.want {
+				t.Fatalf("Latency.GetURL() got %s wanted %s", got, tt.want)
+			}
+			if got := atomic.LoadInt32(&probed); got != tt.wantProbes {
+				t.Fatalf("WithProbeFallback() probed the fallback %d times wanted %d", got, tt.wantProbes)
+			}
+		})
+	}
+}
+
+func TestWithCustomClient(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	l, _ := NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, WithCustomClient(nil), WithCustomClient(httpClient), WithCustomPingInterval(0))
+
+	if !l.IsHealthy(l.Europe) || !l.IsHealthy(l.USEast) {
+		t.Fatalf("Latency.GetLatencies() got %v wanted the endpoints to be probed with the custom client", l.GetLatencies())
+	}
+}
+
+func TestLatency_Ready(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	var up atomic.Value
+	up.Store(false)
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		if !up.Load().(bool) {
+			return 0, ErrTimeout
+		}
+		return 10 * time.Millisecond, nil
+	})
+
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+	l, _ := NewLatencyRouter(endpoints, probe, WithRegionDetector(StaticRegionDetector("eu-west-1")))
+	if l.Ready() || l.GetURL() != endpoints.Europe {
+		t.Fatalf("Latency.Ready() got %v for the seeded %s wanted false", l.Ready(), l.GetURL())
+	}
+
+	l.findLowLatencyEndpoint(context.Background())
+	if l.Ready() {
+		t.Fatalf("Latency.Ready() got true wanted false after every endpoint failed")
+	}
+
+	up.Store(true)
+	l.findLowLatencyEndpoint(context.Background())
+	if !l.Ready() || !l.Stats().Ready {
+		t.Fatalf("Latency.Ready() got false wanted true once a check selected an endpoint")
+	}
+
+	if err := l.UpdateEndpoints(endpoints); err != nil {
+		t.Fatalf("Latency.UpdateEndpoints() error %v", err)
+	}
+	if l.Ready() {
+		t.Fatalf("Latency.Ready() got true wanted false after the endpoints were replaced")
+	}
+}
+
+func TestWithShuffleProbeOrder(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	endpoints := EndPoints{
+		Europe:      "http://foobar.com?region=eu",
+		USEast:      "http://foobar.com?region=us-east",
+		AsiaPacific: "http://foobar.com?region=apac",
+		Fallback:    "http://foobar.com?region=fallback",
+	}
+
+	tests := []struct {
+		name      string
+		options   []func(*Latency)
+		wantFirst int
+	}{
+		{name: "should start with different endpoints by default", wantFirst: 3},
+		{name: "should keep the order", options: []func(*Latency){WithShuffleProbeOrder(false)}, wantFirst: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _ := NewLatencyRouter(endpoints, tt.options...)
+			first := make(map[string]bool)
+			// the chance of 60 shuffles never starting with one of the three endpoints is negligible
+			for i := 0; i < 60; i++ {
+				order := l.probeOrder(l.probeEndpoints())
+				if len(order) != 3 {
+					t.Fatalf("Latency.probeOrder() got %v wanted every endpoint", order)
+				}
+				first[order[0]] = true
+			}
+			if len(first) != tt.wantFirst {
+				t.Fatalf("Latency.probeOrder() started with %v wanted %d different endpoints", first, tt.wantFirst)
+			}
+		})
+	}
+}
+
+func TestWithOnProbeError(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.String(), "eu") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	var mu sync.Mutex
+	failed := make(map[string][]error)
+	var l *Latency
+	l, _ = NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, func(l *Latency) {
+		l.Client = httpClient
+	}, WithProbeRetries(2, 0), WithOnProbeError(func(url string, err error) {
+		// the router is not locked, so it can be called back into
+		l.GetLatencies()
+		mu.Lock()
+		defer mu.Unlock()
+		failed[url] = append(failed[url], err)
+	}))
+	l.findLowLatencyEndpoint(context.Background())
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(failed) != 1 || len(failed[l.Europe]) != 2 {
+		t.Fatalf("WithOnProbeError() got %v wanted both attempts of %s", failed, l.Europe)
+	}
+	for _, err := range failed[l.Europe] {
+		if errors.Cause(err) != ErrBadStatus {
+			t.Fatalf("WithOnProbeError() got %v wanted %v", err, ErrBadStatus)
+		}
+	}
+}
+
+func TestWithOnProbeError_clientError(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.String(), "eu") {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+	httpClient.Timeout = 50 * time.Millisecond
+
+	var mu sync.Mutex
+	var failed []error
+	l, _ := NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, func(l *Latency) {
+		l.Client = httpClient
+	}, WithRegionDetector(StaticRegionDetector("eu-west-1")), WithOnProbeError(func(url string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failed = append(failed, err)
+	}))
+	l.findLowLatencyEndpoint(context.Background())
+
+	mu.Lock()
+	defer mu.Unlock()
+	// the three attempts on the preset and the probe of the full check
+	if len(failed) != 4 {
+		t.Fatalf("WithOnProbeError() got %v wanted every attempt of %s", failed, l.Europe)
+	}
+	for _, err := range failed {
+		netErr, ok := err.(net.Error)
+		if err == ErrTimeout || !ok || !netErr.Timeout() || !strings.Contains(err.Error(), "foobar.com") {
+			t.Fatalf("WithOnProbeError() got %v wanted the client's timeout error as is", err)
+		}
+	}
+}
+
+func TestWithAutoProbeMethod(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	var mu sync.Mutex
+	var options int
+	methods := make(map[string][]string)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		region := r.URL.Query().Get("region")
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodOptions {
+			options++
+			switch region {
+			case "eu":
+				w.Header().Set("Allow", "GET, OPTIONS")
+			case "us-east":
+				w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		methods[region] = append(methods[region], r.Method)
+		if region == "eu" && r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	l, _ := NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		USWest:   "http://foobar.com?region=us-west",
+		Fallback: "http://foobar.com?region=fallback",
+	}, func(l *Latency) {
+		l.Client = httpClient
+	}, WithAutoProbeMethod(true))
+	l.findLowLatencyEndpoint(context.Background())
+	l.findLowLatencyEndpoint(context.Background())
+
+	mu.Lock()
+	defer mu.Unlock()
+	if options != 3 {
+		t.Fatalf("WithAutoProbeMethod() sent %d OPTIONS requests wanted one per endpoint", options)
+	}
+	want := map[string][]string{
+		"eu":      {http.MethodGet, http.MethodGet},
+		"us-east": {http.MethodHead, http.MethodHead},
+		// without an Allow header HEAD is used
+		"us-west": {http.MethodHead, http.MethodHead},
+	}
+	if !reflect.DeepEqual(methods, want) {
+		t.Fatalf("WithAutoProbeMethod() probed with %v wanted %v", methods, want)
+	}
+	if !l.IsHealthy(l.Europe) {
+		t.Fatalf("Latency.IsHealthy() got false wanted the GET only endpoint to be healthy")
+	}
+}
+
+func TestLatency_GetURLWait(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	os.Setenv("AWS_REGION", "")
+	release := make(chan struct{})
+	probe := WithProbeFunc(func(ctx context.Context, url string) (time.Duration, error) {
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		if strings.Contains(url, "eu") {
+			return 5 * time.Millisecond, nil
+		}
+		return 50 * time.Millisecond, nil
+	})
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	l, _ := NewLatencyRouter(endpoints, probe, WithCustomPingInterval(time.Hour))
+	defer l.Close()
+	if got := l.GetURLWait(10 * time.Millisecond); got != endpoints.Fallback {
+		t.Fatalf("Latency.GetURLWait() got %s wanted %s once the timeout expired", got, endpoints.Fallback)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+	if got := l.GetURLWait(time.Second); got != endpoints.Europe {
+		t.Fatalf("Latency.GetURLWait() got %s wanted the measured %s", got, endpoints.Europe)
+	}
+
+	start := time.Now()
+	static, _ := NewLatencyRouter(endpoints)
+	if got := static.GetURLWait(time.Second); got != endpoints.Fallback || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("Latency.GetURLWait() got %s after %v wanted %s right away without a ping goroutine", got, time.Since(start), endpoints.Fallback)
+	}
+}
+
+func TestWithProbeRequest(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	var mu sync.Mutex
+	var received []string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, strings.Join([]string{r.Host, r.Method, r.URL.RequestURI(), r.Header.Get("X-Probe"), string(body)}, " "))
+		mu.Unlock()
+		if r.Method != http.MethodPost || r.URL.Path != "/ping" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(body)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	l, _ := NewLatencyRouter(EndPoints{
+		Europe:   "http://eu.foobar.com",
+		USEast:   "http://us-east.foobar.com",
+		Fallback: "http://fallback.foobar.com",
+	}, func(l *Latency) {
+		l.Client = httpClient
+	}, WithProbeHeaders(http.Header{"X-Probe": []string{"router"}}), WithProbeRequest(func() *http.Request {
+		// the host of an absolute URL is replaced by each endpoint's
+		req, _ := http.NewRequest(http.MethodPost, "http://elsewhere.foobar.com/ping?probe=1", strings.NewReader("ping"))
+		return req
+	}))
+	l.findLowLatencyEndpoint(context.Background())
+	l.findLowLatencyEndpoint(context.Background())
+
+	if !l.IsHealthy(l.Europe) || !l.IsHealthy(l.USEast) {
+		t.Fatalf("Latency.GetLatencies() got %v wanted the POST probes to succeed", l.GetLatencies())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string]int{
+		"eu.foobar.com POST /ping?probe=1 router ping":      2,
+		"us-east.foobar.com POST /ping?probe=1 router ping": 2,
+	}
+	got := make(map[string]int)
+	for _, r := range received {
+		got[r]++
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("WithProbeRequest() sent %v wanted every probe to reach its endpoint with its own body", got)
+	}
+}
+
+func TestLatency_periodicallyPingEndpoints(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	if testing.Short() {
+		t.Skip("skipping")
+	}
+
+	os.Setenv("AWS_REGION", "")
+	type args struct {
+		currentLocal string
+		useFallback  bool
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "should pick us-east because we are located in us-east",
+			args: args{
+				currentLocal: "us-east",
+			},
+		},
+		{
+			name: "should pick us-west because we are located in us-west",
+			args: args{
+				currentLocal: "us-west",
+			},
+		},
+		{
+			name: "should pick apac because we are located in apac",
+			args: args{
+				currentLocal: "apac",
+			},
+		},
+		{
+			name: "should pick eu because we are located in eu",
+			args: args{
+				currentLocal: "eu",
+			},
+		},
+		{
+			name: "should pick eu because we are located in eu",
+			args: args{
+				currentLocal: "eu",
+			},
+		},
+		{
+			name: "should use the fallback",
+			args: args{
+				currentLocal: "fallback",
+				useFallback:  true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if len(tt.args.currentLocal) == 0 {
+
+				}
+
+				switch {
+				case strings.Contains(r.URL.String(), tt.args.currentLocal) || len(tt.args.currentLocal) == 0:
+					// if this is the region it is from "no latency is added"
+				default:
+					time.Sleep(20 * time.Millisecond)
+				}
+				w.WriteHeader(http.StatusOK)
+			})
+
+			httpClient, teardown := testingHTTPClient(h)
+			defer teardown()
+
+			client := func(l *Latency) {
+				l.Client = httpClient
+			}
+
+			endpoints := EndPoints{
+				AsiaPacific: "http://foobar.com?region=apac",
+				Europe:      "http://foobar.com?region=eu",
+				Universal:   "http://foobar.com?region=universal",
+				USEast:      "http://foobar.com?region=us-east",
+				USWest:      "http://foobar.com?region=us-west",
+				Fallback:    "http://foobar.com?region=fallback",
+			}
+
+			if tt.args.useFallback {
+				endpoints = EndPoints{
+					Fallback: "http://foobar.com?region=fallback",
+				}
+			}
+
+			refresh := func(l *Latency) {
+				l.PingInterval = 500 * time.Millisecond
+			}
+
+			l, err := NewLatencyRouter(endpoints, client, refresh)
+			if tt.args.useFallback {
+				if errors.Cause(err) != ErrInsufficientEndpointsForLatency {
+					t.Fatalf("NewLatencyRouter() error = %v wanted %v", err, ErrInsufficientEndpointsForLatency)
+				}
+				return
+			}
+			l.StopPingingEndpoints()
+			time.Sleep(2500 * time.Millisecond)
+
+			if !strings.Contains(l.GetURL(), tt.args.currentLocal) {
+				t.Fatalf("Latency.findLowLatencyEndpoint() got %s wanted an endpoint containing %s", l.FastestURL, tt.args.currentLocal)
+			}
+
+		})
+	}
+}
+
+func TestResourcesAreReleased(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	endpoints := EndPoints{
+		AsiaPacific: "http://foobar.com?region=apac",
+		Europe:      "http://foobar.com?region=eu",
+		Universal:   "http://foobar.com?region=universal",
+		USEast:      "http://foobar.com?region=us-east",
+		USWest:      "http://foobar.com?region=us-west",
+		Fallback:    "http://foobar.com?region=fallback",
+	}
+
+	refresh := func(l *Latency) {
+		l.PingInterval = 500 * time.Millisecond
+	}
+
+	for i := 0; i < 10; i++ {
+		l, _ := NewLatencyRouter(endpoints, client, refresh)
+		l.StopPingingEndpoints()
+	}
+	time.Sleep(1000 * time.Millisecond)
+}
+
+func TestLatency_findLowLatencyEndpointReleasesProbes(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.String(), "apac") {
+			// the slow endpoint only answers once its probe gives up
+			<-r.Context().Done()
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+	httpClient.Timeout = 100 * time.Millisecond
+
+	l, _ := NewLatencyRouter(EndPoints{
+		AsiaPacific: "http://foobar.com?region=apac",
+		USEast:      "http://foobar.com?region=us-east",
+		Fallback:    "http://foobar.com?region=fallback",
+	}, func(l *Latency) {
+		l.Client = httpClient
+	})
+
+	l.findLowLatencyEndpoint(context.Background())
+	if got := l.GetURL(); got != l.USEast {
+		t.Fatalf("Latency.GetURL() got %s wanted %s", got, l.USEast)
+	}
+	// every probe, including the one that lost, has finished by the time the check returns
+	httpClient.CloseIdleConnections()
+}
+
+func TestLatency_CloseWaitsForThePingGoroutine(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	os.Setenv("AWS_REGION", "")
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		time.Sleep(20 * time.Millisecond)
+		return time.Millisecond, nil
+	})
+
+	l, _ := NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, probe, WithCustomPingInterval(5*time.Millisecond))
+
+	time.Sleep(30 * time.Millisecond)
+	l.Close()
+	select {
+	case <-l.done:
+	default:
+		t.Fatal("Latency.Close() returned before the ping goroutine exited")
+	}
+
+	// without a ping goroutine there is nothing to wait for
+	l, _ = NewLatencyRouter(EndPoints{
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, probe)
+	l.Wait()
+}
+
+func TestLatency_StopPingingEndpointsIsIdempotent(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	refresh := func(l *Latency) {
+		l.PingInterval = 50 * time.Millisecond
+	}
+
+	l, err := NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, client, refresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.StopPingingEndpoints()
+	l.StopPingingEndpoints()
+	l.StopPingingEndpoints()
+	httpClient.CloseIdleConnections()
+	time.Sleep(200 * time.Millisecond)
+}
+
+func TestNewLatencyRouterContext(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	refresh := func(l *Latency) {
+		l.PingInterval = 50 * time.Millisecond
+	}
+
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l, err := NewLatencyRouterContext(ctx, endpoints, client, refresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	for i := 0; i < 3; i++ {
+		if err := l.Close(); err != nil {
+			t.Fatalf("Latency.Close() unexpected error %v", err)
+		}
+	}
+	httpClient.CloseIdleConnections()
+	time.Sleep(200 * time.Millisecond)
 }
 
 func testingHTTPClient(handler http.Handler) (*http.Client, func()) {
@@ -0,0 +1,67 @@
+package router
+
+import (
+	"math/rand"
+	"time"
+)
+
+// GetBalancedEndpoint spreads calls across the endpoints whose last latency is within the balance tolerance of the fastest
+// each of them is picked at random, weighted inversely by its latency, GetURL keeps returning the single fastest endpoint
+// endpoints that are cooling down or not proven yet are left out, weights and averages apply like they do for GetURL
+// without a tolerance, an override, a fresh check or any healthy measurement it returns what GetURL returns
+func (l *Latency) GetBalancedEndpoint() string {
+	current := l.GetURL()
+
+	l.mu.RLock()
+	if len(l.override) > 0 || l.balanceTolerance <= 0 || l.isStale() {
+		l.mu.RUnlock()
+		return current
+	}
+	var measured []LatencyResult
+	for _, endpoint := range l.contenders() {
+		if latency, ok := l.latencies[endpoint]; ok {
+			measured = append(measured, LatencyResult{URL: endpoint, Duration: latency})
+		}
+	}
+	l.mu.RUnlock()
+
+	// the candidates go through the same filters and adjustments as the selection of the fastest endpoint
+	eligible := l.withoutUnprovenEndpoints(l.withoutBrokenEndpoints(measured))
+	var candidates []LatencyResult
+	fastest := time.Hour
+	for _, result := range l.withEndpointWeights(l.withRegionalPreference(l.averageLatencies(eligible))) {
+		if result.Duration >= time.Hour {
+			continue
+		}
+		candidates = append(candidates, result)
+		if result.Duration < fastest {
+			fastest = result.Duration
+		}
+	}
+
+	var total float64
+	weights := make([]float64, 0, len(candidates))
+	balanced := candidates[:0]
+	for _, candidate := range candidates {
+		if candidate.Duration-fastest > l.balanceTolerance {
+			continue
+		}
+		// a zero latency would divide by zero, nothing is faster than a nanosecond anyway
+		weight := 1 / float64(candidate.Duration+time.Nanosecond)
+		weights = append(weights, weight)
+		balanced = append(balanced, candidate)
+		total += weight
+	}
+	if len(balanced) == 0 {
+		return current
+	}
+
+	pick := rand.Float64() * total
+	for i, weight := range weights {
+		if pick < weight {
+			return balanced[i].URL
+		}
+		pick -= weight
+	}
+	return balanced[len(balanced)-1].URL
+}
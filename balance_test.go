@@ -0,0 +1,72 @@
+package router
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLatency_GetBalancedEndpoint(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	endpoints := EndPoints{
+		AsiaPacific: "http://foobar.com?region=apac",
+		Europe:      "http://foobar.com?region=eu",
+		USEast:      "http://foobar.com?region=us-east",
+		Fallback:    "http://foobar.com?region=fallback",
+	}
+
+	latencies := map[string]time.Duration{
+		endpoints.USEast:      10 * time.Millisecond,
+		endpoints.Europe:      20 * time.Millisecond,
+		endpoints.AsiaPacific: 100 * time.Millisecond,
+	}
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		return latencies[url], nil
+	})
+
+	l, _ := NewLatencyRouter(endpoints, probe)
+	l.findLowLatencyEndpoint(context.Background())
+	if got := l.GetBalancedEndpoint(); got != endpoints.USEast {
+		t.Fatalf("Latency.GetBalancedEndpoint() got %s wanted %s without a tolerance", got, endpoints.USEast)
+	}
+
+	l, _ = NewLatencyRouter(endpoints, probe, WithBalanceTolerance(15*time.Millisecond))
+	if got := l.GetBalancedEndpoint(); got != endpoints.Fallback {
+		t.Fatalf("Latency.GetBalancedEndpoint() got %s wanted %s before any probe", got, endpoints.Fallback)
+	}
+
+	l.findLowLatencyEndpoint(context.Background())
+	picks := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		picks[l.GetBalancedEndpoint()]++
+	}
+	if picks[endpoints.AsiaPacific] != 0 {
+		t.Fatalf("Latency.GetBalancedEndpoint() picked %s %d times wanted it outside the tolerance", endpoints.AsiaPacific, picks[endpoints.AsiaPacific])
+	}
+	// us-east is twice as fast, so it's weighted to be picked twice as often as eu
+	if picks[endpoints.Europe] < 700 || picks[endpoints.USEast] < picks[endpoints.Europe] {
+		t.Fatalf("Latency.GetBalancedEndpoint() got %v wanted us-east and eu to be weighted by latency", picks)
+	}
+	if got := l.GetURL(); got != endpoints.USEast {
+		t.Fatalf("Latency.GetURL() got %s wanted the single fastest %s", got, endpoints.USEast)
+	}
+
+	// eu failed once, it's cooling down even though its next probe succeeded
+	failing := true
+	flaky := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		if url == endpoints.Europe && failing {
+			return 0, ErrTimeout
+		}
+		return latencies[url], nil
+	})
+	l, _ = NewLatencyRouter(endpoints, flaky, WithBalanceTolerance(15*time.Millisecond), WithFailureThreshold(1, time.Hour))
+	l.findLowLatencyEndpoint(context.Background())
+	failing = false
+	l.findLowLatencyEndpoint(context.Background())
+	for i := 0; i < 100; i++ {
+		if got := l.GetBalancedEndpoint(); got != endpoints.USEast {
+			t.Fatalf("Latency.GetBalancedEndpoint() got %s wanted %s while eu is cooling down", got, endpoints.USEast)
+		}
+	}
+}
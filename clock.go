@@ -0,0 +1,36 @@
+package router
+
+import "time"
+
+// Clock is the source of time for the ping loop and every timestamp the router keeps, e.g LastProbe or BrokenUntil
+// probe durations are always measured with the time package, a fake clock can't make a slow endpoint fast
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks on C until it's stopped, *time.Ticker wrapped by realClock is the default
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the default clock, it's backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+// realTicker adapts *time.Ticker to Ticker
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
@@ -0,0 +1,263 @@
+package router
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+)
+
+// fakeClock only moves when advanced, every advance is delivered as a tick to the ticker that's waiting
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	ticks chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, ticks: make(chan time.Time)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(time.Duration) Ticker {
+	return fakeTicker{c.ticks}
+}
+
+// advance moves the clock forward and blocks until the ping loop received the tick
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	c.mu.Unlock()
+	c.ticks <- now
+}
+
+// forward moves the clock forward without delivering a tick
+func (c *fakeClock) forward(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+type fakeTicker struct {
+	ticks chan time.Time
+}
+
+func (t fakeTicker) C() <-chan time.Time {
+	return t.ticks
+}
+
+func (fakeTicker) Stop() {}
+
+func TestWithClock(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	os.Setenv("AWS_REGION", "")
+	var probes int32
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		atomic.AddInt32(&probes, 1)
+		return time.Millisecond, nil
+	})
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := newFakeClock(start)
+	l, _ := NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, probe, WithClock(clock), WithCustomPingInterval(time.Hour))
+
+	// the second tick is only received once the check started by the first one completed
+	clock.advance(time.Hour)
+	clock.advance(time.Hour)
+	l.Close()
+
+	if got := atomic.LoadInt32(&probes); got != 6 {
+		t.Fatalf("probed %d times wanted the initial check and one per tick", got)
+	}
+	if got, want := l.LastProbeTime(), start.Add(2*time.Hour); !got.Equal(want) {
+		t.Fatalf("Latency.LastProbeTime() got %v wanted the fake clock's %v", got, want)
+	}
+
+	// a nil clock keeps the real one
+	l, _ = NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, probe, WithClock(nil))
+	l.findLowLatencyEndpoint(context.Background())
+	if l.LastProbeTime().IsZero() {
+		t.Fatalf("Latency.LastProbeTime() got the zero time wanted the real clock's")
+	}
+}
+
+func TestWithInitialProbeDelay(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	os.Setenv("AWS_REGION", "")
+	var probes int32
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		atomic.AddInt32(&probes, 1)
+		return time.Millisecond, nil
+	})
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	clock := newFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	l, _ := NewLatencyRouter(endpoints, probe, WithClock(clock), WithCustomPingInterval(time.Hour), WithInitialProbeDelay(time.Minute))
+	if got := atomic.LoadInt32(&probes); got != 0 || l.GetURL() != endpoints.Fallback {
+		t.Fatalf("probed %d times and routed to %s wanted no probe and the fallback during the delay", got, l.GetURL())
+	}
+
+	// the delay is over once the clock ticks, the first check runs right after
+	clock.advance(time.Minute)
+	clock.advance(time.Hour)
+	l.Close()
+	if got := atomic.LoadInt32(&probes); got != 4 {
+		t.Fatalf("probed %d times wanted the delayed check and one per tick", got)
+	}
+
+	// a delay drawn as zero doesn't wait at all, a ticker can't tick every 0s
+	for i := 0; i < 20; i++ {
+		l, _ = NewLatencyRouter(endpoints, probe, WithCustomPingInterval(time.Hour), WithInitialProbeDelay(1))
+		l.Close()
+	}
+
+	// a router stopped during the delay never probes
+	atomic.StoreInt32(&probes, 0)
+	l, _ = NewLatencyRouter(endpoints, probe, WithClock(newFakeClock(time.Now())), WithCustomPingInterval(time.Hour), WithInitialProbeDelay(time.Hour))
+	l.Close()
+	if got := atomic.LoadInt32(&probes); got != 0 {
+		t.Fatalf("probed %d times wanted none after closing during the delay", got)
+	}
+}
+
+func TestWithStaleAfter(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		return time.Millisecond, nil
+	})
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	clock := newFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	l, _ := NewLatencyRouter(endpoints, probe, WithClock(clock), WithStaleAfter(time.Minute), WithRegionDetector(StaticRegionDetector("eu-west-1")))
+	clock.forward(time.Hour)
+	if got := l.GetURL(); got != endpoints.Europe {
+		t.Fatalf("Latency.GetURL() got %s wanted the closest %s before any check", got, endpoints.Europe)
+	}
+
+	l.findLowLatencyEndpoint(context.Background())
+	clock.forward(time.Minute)
+	if got := l.GetURL(); got != endpoints.Europe {
+		t.Fatalf("Latency.GetURL() got %s wanted %s while the check is fresh", got, endpoints.Europe)
+	}
+
+	clock.forward(time.Second)
+	if got := l.GetURL(); got != endpoints.Fallback {
+		t.Fatalf("Latency.GetURL() got %s wanted %s once the check is stale", got, endpoints.Fallback)
+	}
+
+	l.findLowLatencyEndpoint(context.Background())
+	if got := l.GetURL(); got != endpoints.Europe {
+		t.Fatalf("Latency.GetURL() got %s wanted %s after a new check", got, endpoints.Europe)
+	}
+}
+
+func TestWithLazyProbe(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	os.Setenv("AWS_REGION", "")
+	var probes int32
+	release := make(chan struct{})
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		<-release
+		atomic.AddInt32(&probes, 1)
+		if url == "http://foobar.com?region=eu" {
+			return time.Millisecond, nil
+		}
+		return 10 * time.Millisecond, nil
+	})
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	clock := newFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	l, _ := NewLatencyRouter(endpoints, probe, WithClock(clock), WithLazyProbe(time.Minute), WithCustomPingInterval(time.Second))
+	defer l.Close()
+
+	// concurrent calls share a single check and get the current selection meanwhile
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := l.GetURL(); got != endpoints.Fallback {
+				t.Errorf("Latency.GetURL() got %s wanted %s during the check", got, endpoints.Fallback)
+			}
+		}()
+	}
+	wg.Wait()
+	close(release)
+	l.Wait()
+	if got := atomic.LoadInt32(&probes); got != 2 {
+		t.Fatalf("probed %d times wanted a single check", got)
+	}
+
+	// a fresh check is not repeated
+	if got := l.GetURL(); got != endpoints.Europe {
+		t.Fatalf("Latency.GetURL() got %s wanted %s", got, endpoints.Europe)
+	}
+	l.Wait()
+	if got := atomic.LoadInt32(&probes); got != 2 {
+		t.Fatalf("probed %d times wanted no check within the ttl", got)
+	}
+
+	clock.forward(2 * time.Minute)
+	l.GetURL()
+	l.Wait()
+	if got := atomic.LoadInt32(&probes); got != 4 {
+		t.Fatalf("probed %d times wanted a new check once the ttl expired", got)
+	}
+
+	// no check starts once the router is closed
+	clock.forward(2 * time.Minute)
+	l.Close()
+	l.GetURL()
+	l.Wait()
+	if got := atomic.LoadInt32(&probes); got != 4 {
+		t.Fatalf("probed %d times wanted no check after Close", got)
+	}
+
+	// nor once the constructor's context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	l, _ = NewLatencyRouterContext(ctx, endpoints, probe, WithLazyProbe(time.Minute), WithCustomPingInterval(time.Second))
+	defer l.Close()
+	cancel()
+	l.GetURL()
+	l.Wait()
+	if got := atomic.LoadInt32(&probes); got != 4 {
+		t.Fatalf("probed %d times wanted no check once the context is done", got)
+	}
+
+	// the first check started by GetURLWait is waited for
+	l, _ = NewLatencyRouter(endpoints, probe, WithLazyProbe(time.Minute), WithCustomPingInterval(time.Second))
+	defer l.Close()
+	if got := l.GetURLWait(time.Second); got != endpoints.Europe || !l.Ready() {
+		t.Fatalf("Latency.GetURLWait() got %s wanted %s once the lazy check completed", got, endpoints.Europe)
+	}
+}
@@ -0,0 +1,29 @@
+package router
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// NewLatencyRouterFromJSON decodes the endpoints from JSON, using the json tags of EndPoints, and builds a router with them
+// a config that can't be decoded returns ErrMalformedConfig, a config that decodes but isn't valid returns the validation error
+func NewLatencyRouterFromJSON(r io.Reader, options ...func(*Latency)) (*Latency, error) {
+	var endpoints EndPoints
+	if err := json.NewDecoder(r).Decode(&endpoints); err != nil {
+		return nil, errors.Wrap(ErrMalformedConfig, err.Error())
+	}
+	return NewLatencyRouter(endpoints, options...)
+}
+
+// NewLatencyRouterFromYAML decodes the endpoints from YAML, using the same snake_case names as the JSON config, and builds a router with them
+// a config that can't be decoded returns ErrMalformedConfig, a config that decodes but isn't valid returns the validation error
+func NewLatencyRouterFromYAML(r io.Reader, options ...func(*Latency)) (*Latency, error) {
+	var endpoints EndPoints
+	if err := yaml.NewDecoder(r).Decode(&endpoints); err != nil {
+		return nil, errors.Wrap(ErrMalformedConfig, err.Error())
+	}
+	return NewLatencyRouter(endpoints, options...)
+}
@@ -0,0 +1,84 @@
+package router
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestNewLatencyRouterFromJSON(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	tests := []struct {
+		name    string
+		config  string
+		wantErr error
+	}{
+		{
+			name:   "should build a router from valid json",
+			config: `{"us_east": "https://us-east.foobar.com", "fallback": "https://fallback.foobar.com", "custom_regions": {"sa-east-1": "https://sa-east.foobar.com"}}`,
+		},
+		{
+			name:    "should fail with ErrMalformedConfig on broken json",
+			config:  `{"us_east": "https://us-east.foobar.com",`,
+			wantErr: ErrMalformedConfig,
+		},
+		{
+			name:    "should fail with the validation error on valid json",
+			config:  `{"us_east": "https://us-east.foobar.com"}`,
+			wantErr: ErrFallbackUnset,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewLatencyRouterFromJSON(strings.NewReader(tt.config))
+			if errors.Cause(err) != tt.wantErr {
+				t.Fatalf("NewLatencyRouterFromJSON() error = %v, wanted %v", err, tt.wantErr)
+			}
+			if err == nil && l.CustomRegions["sa-east-1"] != "https://sa-east.foobar.com" {
+				t.Fatalf("NewLatencyRouterFromJSON() got %v wanted the custom region to be decoded", l.CustomRegions)
+			}
+		})
+	}
+}
+
+func TestNewLatencyRouterFromYAML(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	tests := []struct {
+		name    string
+		config  string
+		wantErr error
+	}{
+		{
+			name: "should build a router from valid yaml",
+			config: `
+us_east: https://us-east.foobar.com
+fallback: https://fallback.foobar.com
+custom_regions:
+  sa-east-1: https://sa-east.foobar.com
+`,
+		},
+		{
+			name:    "should fail with ErrMalformedConfig on broken yaml",
+			config:  "us_east: [https://us-east.foobar.com",
+			wantErr: ErrMalformedConfig,
+		},
+		{
+			name:    "should fail with the validation error on valid yaml",
+			config:  "us_east: https://us-east.foobar.com",
+			wantErr: ErrFallbackUnset,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewLatencyRouterFromYAML(strings.NewReader(tt.config))
+			if errors.Cause(err) != tt.wantErr {
+				t.Fatalf("NewLatencyRouterFromYAML() error = %v, wanted %v", err, tt.wantErr)
+			}
+			if err == nil && l.CustomRegions["sa-east-1"] != "https://sa-east.foobar.com" {
+				t.Fatalf("NewLatencyRouterFromYAML() got %v wanted the custom region to be decoded", l.CustomRegions)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package router
+
+import "time"
+
+// probeEventBuffer is how many events are held for a slow consumer before new ones are dropped
+const probeEventBuffer = 64
+
+// ProbeEvent is the outcome of probing a single endpoint
+type ProbeEvent struct {
+	URL string
+	// Duration is the measured round trip time, time.Hour when the probe failed
+	Duration time.Duration
+	// Err is the last error of the probe, nil when it succeeded
+	Err  error
+	Time time.Time
+}
+
+// Events returns a channel receiving an event after every endpoint probe, it's closed by Close
+// events are dropped while the buffer is full, so a slow consumer never stalls probing
+// the channel is created on the first call, without a listener no events are built
+func (l *Latency) Events() <-chan ProbeEvent {
+	l.eventsMu.Lock()
+	defer l.eventsMu.Unlock()
+
+	if l.events == nil {
+		l.events = make(chan ProbeEvent, probeEventBuffer)
+		if l.eventsClosed {
+			close(l.events)
+		}
+	}
+	return l.events
+}
+
+// emitEvent sends the event without blocking, it's a no-op until Events is called
+func (l *Latency) emitEvent(endpoint string, duration time.Duration, err error) {
+	l.eventsMu.RLock()
+	defer l.eventsMu.RUnlock()
+
+	if l.events == nil || l.eventsClosed {
+		return
+	}
+	select {
+	case l.events <- ProbeEvent{URL: endpoint, Duration: duration, Err: err, Time: l.clock.Now()}:
+	default:
+		l.logf("the events buffer is full, dropping the event for %s", endpoint)
+	}
+}
+
+// closeEvents closes the events channel, probes still in flight stop emitting
+func (l *Latency) closeEvents() {
+	l.eventsMu.Lock()
+	defer l.eventsMu.Unlock()
+
+	if l.eventsClosed {
+		return
+	}
+	l.eventsClosed = true
+	if l.events != nil {
+		close(l.events)
+	}
+}
@@ -0,0 +1,79 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatency_Events(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.String(), "eu") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	l, _ := NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, func(l *Latency) {
+		l.Client = httpClient
+	})
+
+	events := l.Events()
+	l.findLowLatencyEndpoint(context.Background())
+
+	got := make(map[string]ProbeEvent)
+	for i := 0; i < 2; i++ {
+		event := <-events
+		got[event.URL] = event
+	}
+	if event := got[l.USEast]; event.Err != nil || event.Duration >= time.Hour || event.Time.IsZero() {
+		t.Fatalf("Latency.Events() got %+v wanted a successful probe of %s", event, l.USEast)
+	}
+	if event := got[l.Europe]; event.Err == nil || event.Duration != time.Hour {
+		t.Fatalf("Latency.Events() got %+v wanted a failed probe of %s", event, l.Europe)
+	}
+
+	// nobody reads the events, probing must carry on once the buffer is full
+	for i := 0; i < probeEventBuffer; i++ {
+		l.findLowLatencyEndpoint(context.Background())
+	}
+	if got := len(events); got != probeEventBuffer {
+		t.Fatalf("Latency.Events() buffered %d events wanted %d", got, probeEventBuffer)
+	}
+
+	l.Close()
+	for range events {
+	}
+	if _, ok := <-l.Events(); ok {
+		t.Fatal("Latency.Events() should be closed after Close")
+	}
+
+	// the check of a preset endpoint emits its probe as well
+	l, _ = NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, func(l *Latency) {
+		l.Client = httpClient
+	}, WithRegionDetector(StaticRegionDetector("us-east-1")))
+	events = l.Events()
+	l.findLowLatencyEndpoint(context.Background())
+	if got := len(events); got != 1 {
+		t.Fatalf("Latency.Events() got %d events wanted the preset's probe", got)
+	}
+	if event := <-events; event.URL != l.USEast || event.Err != nil || event.Duration >= time.Hour {
+		t.Fatalf("Latency.Events() got %+v wanted a successful probe of %s", event, l.USEast)
+	}
+}
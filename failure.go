@@ -0,0 +1,90 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"syscall"
+)
+
+// FailureReason classifies why the last probe of an endpoint failed
+type FailureReason string
+
+const (
+	// FailureTimeout the probe did not complete within the endpoint's timeout
+	FailureTimeout FailureReason = "timeout"
+	// FailureConnectionReset the connection was reset by the endpoint
+	FailureConnectionReset FailureReason = "connection_reset"
+	// FailureConnectionRefused nothing accepted the connection, e.g the service is down
+	FailureConnectionRefused FailureReason = "connection_refused"
+	// FailureDNS the endpoint's host could not be resolved
+	FailureDNS FailureReason = "dns"
+	// FailureTLS the TLS handshake failed or the certificate was rejected
+	FailureTLS FailureReason = "tls"
+	// FailureBadStatus the endpoint answered with a status that isn't considered healthy
+	FailureBadStatus FailureReason = "bad_status"
+	// FailureOther the error could not be classified
+	FailureOther FailureReason = "other"
+)
+
+// classifyFailure walks the chain of wrapped errors until one of them can be classified
+func classifyFailure(err error) FailureReason {
+	for err != nil {
+		switch e := err.(type) {
+		case retryAfterError:
+			return FailureBadStatus
+		case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError, tls.RecordHeaderError:
+			return FailureTLS
+		case *net.DNSError:
+			return FailureDNS
+		case net.Error:
+			if e.Timeout() {
+				return FailureTimeout
+			}
+		}
+
+		switch err {
+		case ErrTimeout, context.DeadlineExceeded:
+			return FailureTimeout
+		case ErrConnectionReset, syscall.ECONNRESET:
+			return FailureConnectionReset
+		case syscall.ECONNREFUSED:
+			return FailureConnectionRefused
+		case ErrNoSuchHost:
+			return FailureDNS
+		case ErrCertificateMismatch:
+			return FailureTLS
+		case ErrBadStatus:
+			return FailureBadStatus
+		}
+		err = unwrapError(err)
+	}
+	return FailureOther
+}
+
+// unwrapError returns the error wrapped by err, either by pkg/errors or the standard library, or nil
+func unwrapError(err error) error {
+	switch e := err.(type) {
+	case interface{ Cause() error }:
+		return e.Cause()
+	case interface{ Unwrap() error }:
+		return e.Unwrap()
+	}
+	return nil
+}
+
+// recordFailureReason keeps the classification of the last probe of the endpoint, a successful probe clears it
+func (l *Latency) recordFailureReason(endpoint string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err == nil {
+		delete(l.failureReasons, endpoint)
+		return
+	}
+	if l.failureReasons == nil {
+		l.failureReasons = make(map[string]FailureReason)
+	}
+	l.failureReasons[endpoint] = classifyFailure(err)
+}
@@ -0,0 +1,115 @@
+package router
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestLatency_FailureReasons(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ok.Close()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+
+	reset := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		// a zero linger makes close send a RST instead of a FIN
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}))
+	defer reset.Close()
+
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer unavailable.Close()
+
+	// the default client doesn't trust the test server's certificate
+	untrusted := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	untrusted.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	untrusted.StartTLS()
+	defer untrusted.Close()
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	refused := closed.URL
+	closed.Close()
+
+	l, err := NewLatencyRouter(EndPoints{
+		USEast:        slow.URL,
+		USWest:        reset.URL,
+		Europe:        refused,
+		AsiaPacific:   untrusted.URL,
+		CustomRegions: map[string]string{"sa-east-1": unavailable.URL, "me-south-1": "http://foobar.invalid", "af-south-1": ok.URL},
+		Fallback:      ok.URL,
+	}, func(l *Latency) {
+		l.Client = &http.Client{Timeout: 200 * time.Millisecond}
+	})
+	if err != nil {
+		t.Fatalf("NewLatencyRouter() error %v", err)
+	}
+	l.findLowLatencyEndpoint(context.Background())
+
+	want := map[string]FailureReason{
+		slow.URL:                FailureTimeout,
+		reset.URL:               FailureConnectionReset,
+		refused:                 FailureConnectionRefused,
+		untrusted.URL:           FailureTLS,
+		unavailable.URL:         FailureBadStatus,
+		"http://foobar.invalid": FailureDNS,
+	}
+	got := l.Stats().FailureReasons
+	for endpoint, reason := range want {
+		if got[endpoint] != reason {
+			t.Errorf("Latency.Stats() FailureReasons[%s] got %q wanted %q", endpoint, got[endpoint], reason)
+		}
+	}
+	if reason, ok := got[ok.URL]; ok {
+		t.Errorf("Latency.Stats() FailureReasons got %q for a healthy endpoint", reason)
+	}
+}
+
+func TestClassifyFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want FailureReason
+	}{
+		{name: "wrapped timeout", err: errors.Wrap(ErrTimeout, "probe"), want: FailureTimeout},
+		{name: "deadline", err: context.DeadlineExceeded, want: FailureTimeout},
+		{name: "connection reset", err: ErrConnectionReset, want: FailureConnectionReset},
+		{name: "no such host", err: ErrNoSuchHost, want: FailureDNS},
+		{name: "certificate mismatch", err: errors.Wrap(ErrCertificateMismatch, "abc"), want: FailureTLS},
+		{name: "retry after", err: retryAfterError{until: time.Now()}, want: FailureBadStatus},
+		{name: "unknown", err: errors.New("boom"), want: FailureOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyFailure(tt.err); got != tt.want {
+				t.Fatalf("classifyFailure() got %q wanted %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -7,4 +7,5 @@ require (
 	go.uber.org/goleak v1.0.0
 	golang.org/x/lint v0.0.0-20200302205851-738671d3881b // indirect
 	golang.org/x/tools v0.0.0-20200515220128-d3bf790afa53 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,76 @@
+package router
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// RouterGroup holds a router per upstream API by name, so their lifecycle is managed in one place
+type RouterGroup struct {
+	mu      sync.RWMutex
+	routers map[string]*Latency
+}
+
+// NewRouterGroup constructs a router for every named set of endpoints with the same options
+// if any of them can't be constructed the ones that were are closed and the error is returned along with the name
+func NewRouterGroup(endpoints map[string]EndPoints, options ...func(*Latency)) (*RouterGroup, error) {
+	names := make([]string, 0, len(endpoints))
+	for name := range endpoints {
+		names = append(names, name)
+	}
+	// the routers are constructed in a stable order, so the same error is returned for the same config
+	sort.Strings(names)
+
+	g := &RouterGroup{routers: make(map[string]*Latency, len(endpoints))}
+	for _, name := range names {
+		l, err := NewLatencyRouter(endpoints[name], options...)
+		if err != nil {
+			g.Close()
+			return nil, errors.Wrap(err, fmt.Sprintf("router %v", name))
+		}
+		g.routers[name] = l
+	}
+	return g, nil
+}
+
+// Get returns the router constructed for the name
+func (g *RouterGroup) Get(name string) (*Latency, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	l, ok := g.routers[name]
+	return l, ok
+}
+
+// Names returns the names of the routers in the group, sorted
+func (g *RouterGroup) Names() []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	names := make([]string, 0, len(g.routers))
+	for name := range g.routers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close closes every router in the group, it returns once all of their ping goroutines exited and always returns a nil error
+// the routers are kept, so Get keeps working and returns their last selection, calling it more than once is a no-op
+func (g *RouterGroup) Close() error {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, l := range g.routers {
+		wg.Add(1)
+		go func(l *Latency) {
+			defer wg.Done()
+			l.Close()
+		}(l)
+	}
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,71 @@
+package router
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/goleak"
+)
+
+func TestRouterGroup(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	os.Setenv("AWS_REGION", "")
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		return time.Millisecond, nil
+	})
+
+	g, err := NewRouterGroup(map[string]EndPoints{
+		"payments": {
+			Europe:   "http://payments.foobar.com?region=eu",
+			USEast:   "http://payments.foobar.com?region=us-east",
+			Fallback: "http://payments.foobar.com?region=fallback",
+		},
+		"search": {
+			Europe:   "http://search.foobar.com?region=eu",
+			USEast:   "http://search.foobar.com?region=us-east",
+			Fallback: "http://search.foobar.com?region=fallback",
+		},
+	}, probe, WithCustomPingInterval(time.Hour), WithBlockUntilReady(time.Second))
+	if err != nil {
+		t.Fatalf("NewRouterGroup() error %v", err)
+	}
+
+	if got, want := g.Names(), []string{"payments", "search"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("RouterGroup.Names() got %v wanted %v", got, want)
+	}
+	l, ok := g.Get("search")
+	if !ok || !l.Ready() || l.USEast != "http://search.foobar.com?region=us-east" {
+		t.Fatalf("RouterGroup.Get() got %v, %v wanted the probed search router", l, ok)
+	}
+	if _, ok := g.Get("billing"); ok {
+		t.Fatalf("RouterGroup.Get() found a router that was never configured")
+	}
+
+	g.Close()
+	g.Close()
+}
+
+func TestNewRouterGroupError(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	os.Setenv("AWS_REGION", "")
+	_, err := NewRouterGroup(map[string]EndPoints{
+		"payments": {
+			Europe:   "http://payments.foobar.com?region=eu",
+			USEast:   "http://payments.foobar.com?region=us-east",
+			Fallback: "http://payments.foobar.com?region=fallback",
+		},
+		"search": {
+			Europe: "http://search.foobar.com?region=eu",
+		},
+	}, WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		return time.Millisecond, nil
+	}), WithCustomPingInterval(time.Hour))
+
+	if errors.Cause(err) != ErrFallbackUnset {
+		t.Fatalf("NewRouterGroup() got %v wanted %v", err, ErrFallbackUnset)
+	}
+}
@@ -0,0 +1,18 @@
+package router
+
+import "time"
+
+// MetricsCollector receives the outcome of every latency probe, it can be adapted to a metrics system such as prometheus
+// implementations must be safe for concurrent use, endpoints are probed in parallel
+type MetricsCollector interface {
+	// ObserveLatency is called with the round trip time of a successful probe
+	ObserveLatency(url string, d time.Duration)
+	// ObserveFailure is called when an endpoint could not be probed successfully
+	ObserveFailure(url string)
+}
+
+// noopMetricsCollector is the default collector, it discards everything
+type noopMetricsCollector struct{}
+
+func (noopMetricsCollector) ObserveLatency(string, time.Duration) {}
+func (noopMetricsCollector) ObserveFailure(string)                {}
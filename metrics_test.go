@@ -0,0 +1,80 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingCollector struct {
+	mu        sync.Mutex
+	latencies map[string]time.Duration
+	failures  map[string]int
+}
+
+func (c *recordingCollector) ObserveLatency(url string, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.latencies[url] = d
+}
+
+func (c *recordingCollector) ObserveFailure(url string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures[url]++
+}
+
+func TestWithMetricsCollector(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.String(), "eu") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	collector := &recordingCollector{latencies: map[string]time.Duration{}, failures: map[string]int{}}
+	l, _ := NewLatencyRouter(endpoints, client, WithMetricsCollector(collector))
+	l.findLowLatencyEndpoint(context.Background())
+
+	if _, ok := collector.latencies[endpoints.USEast]; !ok || len(collector.latencies) != 1 {
+		t.Fatalf("ObserveLatency() got %v wanted only %s", collector.latencies, endpoints.USEast)
+	}
+	if collector.failures[endpoints.Europe] != 1 || len(collector.failures) != 1 {
+		t.Fatalf("ObserveFailure() got %v wanted only %s", collector.failures, endpoints.Europe)
+	}
+
+	// the check of a preset endpoint is observed as well
+	collector = &recordingCollector{latencies: map[string]time.Duration{}, failures: map[string]int{}}
+	l, _ = NewLatencyRouter(endpoints, client, WithMetricsCollector(collector), WithRegionDetector(StaticRegionDetector("us-east-1")))
+	l.findLowLatencyEndpoint(context.Background())
+	if _, ok := collector.latencies[endpoints.USEast]; !ok || len(collector.failures) != 0 {
+		t.Fatalf("ObserveLatency() got %v and ObserveFailure() got %v wanted the preset %s", collector.latencies, collector.failures, endpoints.USEast)
+	}
+
+	collector = &recordingCollector{latencies: map[string]time.Duration{}, failures: map[string]int{}}
+	l, _ = NewLatencyRouter(endpoints, client, WithMetricsCollector(collector), WithRegionDetector(StaticRegionDetector("eu-west-1")))
+	l.findLowLatencyEndpoint(context.Background())
+	// each of the three attempts on the preset and the probe of the full check
+	if got := collector.failures[endpoints.Europe]; got != 4 {
+		t.Fatalf("ObserveFailure() got %d failures for the preset %s wanted 4", got, endpoints.Europe)
+	}
+}
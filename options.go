@@ -0,0 +1,502 @@
+package router
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// WithRegionDetector replaces the default AWS_REGION environment variable lookup with the inputted detector
+func WithRegionDetector(detector RegionDetector) func(*Latency) {
+	return func(l *Latency) {
+		if detector != nil {
+			l.regionDetector = detector
+		}
+	}
+}
+
+// WithRegionMapping replaces DefaultRegionMapping, keys are lower case region names and
+// values return the endpoint which should be used for that region
+func WithRegionMapping(mapping map[string]func(EndPoints) string) func(*Latency) {
+	return func(l *Latency) {
+		if mapping != nil {
+			l.regionMapping = mapping
+		}
+	}
+}
+
+// WithProbeMethod sets the HTTP method used to check endpoints for latency, by default HEAD requests are used
+// GET is useful for APIs that reject HEAD requests, the response body is discarded, any other method is ignored
+func WithProbeMethod(method string) func(*Latency) {
+	return func(l *Latency) {
+		switch method = strings.ToUpper(method); method {
+		case http.MethodHead, http.MethodGet:
+			l.probeMethod = method
+		}
+	}
+}
+
+// WithOnChange registers a callback which is called with the previous and the new URL whenever the fastest endpoint changes
+func WithOnChange(fn func(oldURL, newURL string)) func(*Latency) {
+	return func(l *Latency) {
+		l.onChange = fn
+	}
+}
+
+// WithStickyThreshold keeps the current fastest endpoint as long as it's within d of the newly measured fastest endpoint
+// this avoids flapping between endpoints with nearly equal latencies, the default of zero always picks the fastest
+func WithStickyThreshold(d time.Duration) func(*Latency) {
+	return func(l *Latency) {
+		l.stickyThreshold = d
+	}
+}
+
+// WithProbeRetries probes each endpoint up to n times, waiting backoff between attempts, before it's considered failed
+// retries never outlive the client timeout, so a slow endpoint can't hold up the latency check
+func WithProbeRetries(n int, backoff time.Duration) func(*Latency) {
+	return func(l *Latency) {
+		if n > 0 {
+			l.probeRetries = n
+			l.probeBackoff = backoff
+		}
+	}
+}
+
+// WithSampleWindow selects the fastest endpoint based on the moving average of the last n probes instead of only the last one
+// failed probes count as time.Hour, the default of 1 only uses the last probe
+func WithSampleWindow(n int) func(*Latency) {
+	return func(l *Latency) {
+		if n > 0 {
+			l.sampleWindow = n
+		}
+	}
+}
+
+// WithSelectionPercentile selects the fastest endpoint on a percentile of its recent probes instead of their mean, e.g 90 for p90
+// the probes are the ones kept by WithSampleWindow, which holds n durations per endpoint, a larger window gives a more meaningful tail
+// without a window only the last probe is kept, so it's what every percentile returns, p has to be greater than 0 and at most 100 otherwise it's ignored
+func WithSelectionPercentile(p float64) func(*Latency) {
+	return func(l *Latency) {
+		if p > 0 && p <= 100 {
+			l.selectionPercentile = p
+		}
+	}
+}
+
+// WithMetricsCollector reports the latency or failure of every probe to the inputted collector
+func WithMetricsCollector(collector MetricsCollector) func(*Latency) {
+	return func(l *Latency) {
+		if collector != nil {
+			l.metrics = collector
+		}
+	}
+}
+
+// WithLogger routes all debug output through the inputted logger instead of the standard log package
+// every message is sent to the logger regardless of DebugMode, filtering is left to the logger
+func WithLogger(logger Logger) func(*Latency) {
+	return func(l *Latency) {
+		l.logger = logger
+	}
+}
+
+// WithExpectedCertFingerprint fails any probe whose endpoint presents a leaf certificate with a different sha256 fingerprint
+// the check is installed on a copy of the client's transport, so it never affects the client used by the rest of the application
+func WithExpectedCertFingerprint(sha256 string) func(*Latency) {
+	return func(l *Latency) {
+		l.certFingerprint = normalizeFingerprint(sha256)
+	}
+}
+
+// WithEndpointTimeouts gives individual endpoint URLs their own probe timeout, e.g for a region that is legitimately slower
+// endpoints that are not in the map keep using the client's timeout, a latency check waits for the longest timeout
+func WithEndpointTimeouts(timeouts map[string]time.Duration) func(*Latency) {
+	return func(l *Latency) {
+		l.endpointTimeouts = timeouts
+	}
+}
+
+// WithOnAllFailed registers a callback which is called when none of the endpoints responded during a latency check
+// it's never called when there are no endpoints to probe, e.g when only a fallback is set
+func WithOnAllFailed(fn func()) func(*Latency) {
+	return func(l *Latency) {
+		l.onAllFailed = fn
+	}
+}
+
+// WithTCPProbe measures the time it takes to open a TCP connection to each endpoint instead of making an HTTP request
+// this is useful for endpoints that don't answer plain HTTP requests, such as gRPC load balancers
+// URLs without a port are dialed on 443 for https and 80 for everything else
+func WithTCPProbe() func(*Latency) {
+	return func(l *Latency) {
+		l.tcpProbe = true
+	}
+}
+
+// WithPingJitter randomizes every PingInterval by up to ±fraction of itself, e.g 0.1 turns a minute into 54 to 66 seconds
+// this keeps many instances that start at the same time from probing the endpoints in lockstep, fraction is capped at 1
+func WithPingJitter(fraction float64) func(*Latency) {
+	return func(l *Latency) {
+		if fraction <= 0 {
+			return
+		}
+		if fraction > 1 {
+			fraction = 1
+		}
+		l.pingJitter = fraction
+		// each instance gets its own seed, otherwise every instance would jitter the same way
+		l.jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+}
+
+// WithNetworkPreference forces the network probes are dialed over, "tcp4" or "tcp6" pins the IP version and "tcp" lets the resolver decide
+// it only applies to the internally built client and TCP probes, supplying a custom Client disables it for HTTP probes
+func WithNetworkPreference(network string) func(*Latency) {
+	return func(l *Latency) {
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+			l.network = network
+		}
+	}
+}
+
+// WithFailureThreshold skips an endpoint during selection for cooldown once it failed n probes in a row
+// the endpoint keeps being probed, so it's eligible again as soon as the cooldown elapsed, even if it recovered earlier
+func WithFailureThreshold(n int, cooldown time.Duration) func(*Latency) {
+	return func(l *Latency) {
+		if n > 0 {
+			l.failureThreshold = n
+			l.failureCooldown = cooldown
+		}
+	}
+}
+
+// WithSelector replaces the default lowest duration selection, the selector gets every measured endpoint
+// including the failed ones with a Duration of time.Hour, and returns the URL to use, an empty string is treated as every endpoint failing
+func WithSelector(selector func(results []LatencyResult) string) func(*Latency) {
+	return func(l *Latency) {
+		l.selector = selector
+	}
+}
+
+// WithFollowRedirects times probes end to end across redirects, up to 5 hops, and judges the final response
+// by default redirects are not followed and a 3xx response counts as a healthy endpoint
+func WithFollowRedirects(follow bool) func(*Latency) {
+	return func(l *Latency) {
+		l.followRedirects = follow
+	}
+}
+
+// WithAcceptableStatus replaces the default success check, any 2xx and 3xx when redirects are not followed, e.g for stricter checks
+// it's used by every probe, including the re-check of a preset endpoint
+func WithAcceptableStatus(acceptable func(code int) bool) func(*Latency) {
+	return func(l *Latency) {
+		l.acceptableStatus = acceptable
+	}
+}
+
+// WithPerEndpointStatus sets the success check of individual endpoints, keyed by URL, e.g one region answers 204 and another 301
+// endpoints without a check of their own use the one set with WithAcceptableStatus, or the default success check
+func WithPerEndpointStatus(acceptable map[string]func(code int) bool) func(*Latency) {
+	return func(l *Latency) {
+		l.endpointStatus = make(map[string]func(code int) bool, len(acceptable))
+		for endpoint, fn := range acceptable {
+			l.endpointStatus[endpoint] = fn
+		}
+	}
+}
+
+// WithBlockUntilReady makes the constructor wait for the first latency check to complete, up to timeout
+// so GetURL returns a probed endpoint as soon as the router is returned, when the timeout fires the router is returned as is
+func WithBlockUntilReady(timeout time.Duration) func(*Latency) {
+	return func(l *Latency) {
+		l.blockUntilReady = timeout
+	}
+}
+
+// WithHTTP2Probing makes the internal probe transport negotiate HTTP/2, so probes measure what HTTP/2 clients see
+// the first probe of an endpoint includes the TLS and HTTP/2 handshake, later probes reuse the connection
+// as long as it's not closed for being idle longer than the transport's IdleConnTimeout, a PingInterval above it pays the handshake every time
+// it has no effect when a custom client is supplied, configure its transport, e.g an *http2.Transport, instead
+func WithHTTP2Probing() func(*Latency) {
+	return func(l *Latency) {
+		l.http2 = true
+	}
+}
+
+// WithAlwaysProbeAll probes every endpoint on each check when true, so an endpoint that became faster than the region's closest one is picked up
+// by default only the closest endpoint is checked while it stays healthy
+func WithAlwaysProbeAll(probeAll bool) func(*Latency) {
+	return func(l *Latency) {
+		l.alwaysProbeAll = probeAll
+	}
+}
+
+// WithClientCoordinates sets the approximate location of the client, when no endpoint has been picked by latency or region
+// GetURL returns the regional endpoint nearest to it by great-circle distance instead of Universal or Fallback
+func WithClientCoordinates(latitude, longitude float64) func(*Latency) {
+	return func(l *Latency) {
+		l.hasCoordinates = true
+		l.latitude = latitude
+		l.longitude = longitude
+	}
+}
+
+// WithProxy sends probes through the proxy instead of the one configured in the environment
+// it has no effect when a custom client is supplied
+func WithProxy(proxy *url.URL) func(*Latency) {
+	return func(l *Latency) {
+		l.proxy = http.ProxyURL(proxy)
+	}
+}
+
+// WithNoProxy sends probes directly to the endpoints, ignoring the proxy configured in the environment
+// it has no effect when a custom client is supplied
+func WithNoProxy() func(*Latency) {
+	return func(l *Latency) {
+		l.proxy = func(*http.Request) (*url.URL, error) {
+			return nil, nil
+		}
+	}
+}
+
+// WithProbeFunc replaces the network probe with probe, which returns the latency of the URL or an error when it's unhealthy
+// it's meant for testing routing decisions without network calls, the probe options of the client are not used
+func WithProbeFunc(probe func(ctx context.Context, url string) (time.Duration, error)) func(*Latency) {
+	return func(l *Latency) {
+		l.probeFunc = probe
+	}
+}
+
+// WithRegionalPreference is a tie-breaking knob, bias is added to the Universal endpoint's latency before the fastest endpoint is selected
+// so a DNS load balanced Universal endpoint only wins over a regional one when it's faster by more than bias, zero by default
+func WithRegionalPreference(bias time.Duration) func(*Latency) {
+	return func(l *Latency) {
+		l.regionalBias = bias
+	}
+}
+
+// WithProbeHeaders adds the headers to every probe request, e.g a User-Agent required by a WAF
+// the header is copied, so it's safe to modify after the router is built
+func WithProbeHeaders(header http.Header) func(*Latency) {
+	return func(l *Latency) {
+		l.probeHeaders = make(http.Header, len(header))
+		for key, values := range header {
+			l.probeHeaders[key] = append([]string(nil), values...)
+		}
+	}
+}
+
+// WithCustomClient sets the client endpoints are probed with, a nil client keeps the default client
+// the client is copied before the probe options are applied, so it can be shared with the rest of the application
+func WithCustomClient(client *http.Client) func(*Latency) {
+	return func(l *Latency) {
+		if client != nil {
+			l.Client = client
+		}
+	}
+}
+
+// WithCustomPingInterval sets PingInterval, an interval of zero means probe once during construction and never again
+// no goroutine is started in that case, so there is nothing to stop
+func WithCustomPingInterval(interval time.Duration) func(*Latency) {
+	return func(l *Latency) {
+		if interval <= 0 {
+			l.PingInterval = 0
+			l.probeOnce = true
+			return
+		}
+		l.PingInterval = interval
+		l.probeOnce = false
+	}
+}
+
+// WithFailureBackoff doubles the time until the next check for every check in a row in which all endpoints failed, up to max
+// once any endpoint responds checks are made every PingInterval again, backed off intervals are jittered by WithPingJitter as well
+func WithFailureBackoff(max time.Duration) func(*Latency) {
+	return func(l *Latency) {
+		l.failureBackoff = max
+	}
+}
+
+// WithInsecureSkipVerify turns off certificate verification for probes, it's meant for staging endpoints with self-signed certificates
+// never use it in production, it has no effect when a custom client is supplied
+func WithInsecureSkipVerify(skip bool) func(*Latency) {
+	return func(l *Latency) {
+		l.insecureSkipVerify = skip
+	}
+}
+
+// WithExcludeFromProbe keeps the fields from being probed, by their EndPoints field name, e.g Universal, or custom region name
+// excluded endpoints are never dialed nor picked as the fastest, but GetURL still falls back to them, e.g Universal as a safety net
+func WithExcludeFromProbe(fields ...string) func(*Latency) {
+	return func(l *Latency) {
+		if l.excludeFromProbe == nil {
+			l.excludeFromProbe = make(map[string]bool, len(fields))
+		}
+		for _, field := range fields {
+			l.excludeFromProbe[field] = true
+		}
+	}
+}
+
+// WithBalanceTolerance lets GetBalancedEndpoint spread calls across every endpoint at most tolerance slower than the fastest one
+// without it GetBalancedEndpoint behaves like GetURL
+func WithBalanceTolerance(tolerance time.Duration) func(*Latency) {
+	return func(l *Latency) {
+		l.balanceTolerance = tolerance
+	}
+}
+
+// WithReachabilityMode measures network reachability instead of application health, any HTTP response counts as a successful probe
+// e.g a 401 to an unauthenticated probe proves the endpoint can be reached, only timeouts, connection resets and DNS failures fail
+// Retry-After headers are ignored and WithAcceptableStatus has no effect in this mode
+func WithReachabilityMode() func(*Latency) {
+	return func(l *Latency) {
+		l.reachabilityMode = true
+	}
+}
+
+// WithMaxConcurrentProbes bounds how many endpoints are probed at the same time, e.g to not exhaust a shared connection pool
+// every endpoint is still probed during each check, the check takes longer instead, each probe's timeout starts once it's its turn
+// by default there is no limit
+func WithMaxConcurrentProbes(n int) func(*Latency) {
+	return func(l *Latency) {
+		l.maxConcurrentProbes = n
+	}
+}
+
+// WithClock replaces the clock driving the ping loop and timestamps, e.g with a fake clock to test time based behavior
+// a nil clock is ignored
+func WithClock(clock Clock) func(*Latency) {
+	return func(l *Latency) {
+		if clock != nil {
+			l.clock = clock
+		}
+	}
+}
+
+// WithEndpointWeights multiplies each endpoint's latency by its weight before the fastest endpoint is selected, keyed by URL
+// a weight above 1 penalizes an endpoint, e.g for its egress costs, below 1 favors it, endpoints without a weight count as 1
+// weights have to be positive, otherwise the constructor returns ErrInvalidWeight
+func WithEndpointWeights(weights map[string]float64) func(*Latency) {
+	return func(l *Latency) {
+		l.endpointWeights = make(map[string]float64, len(weights))
+		for endpoint, weight := range weights {
+			l.endpointWeights[endpoint] = weight
+		}
+	}
+}
+
+// WithMinimumHealthySamples requires an endpoint to succeed n probes in a row before it can become the fastest endpoint
+// until then the current selection, or the fallback when there is none, is kept, any failure starts the count over
+func WithMinimumHealthySamples(n int) func(*Latency) {
+	return func(l *Latency) {
+		l.minHealthySamples = n
+	}
+}
+
+// WithProbeFallback makes the fallback a contender, it's probed alongside the regions and selected when it's the fastest endpoint
+// by default the fallback is only the safety net and never probed as a contender, e.g for a single region plus fallback setup this enables latency routing
+func WithProbeFallback(probe bool) func(*Latency) {
+	return func(l *Latency) {
+		l.probeFallback = probe
+	}
+}
+
+// WithInitialProbeDelay delays the first latency check of the ping goroutine by a random duration up to max, e.g so a rollout doesn't probe every endpoint at once
+// until then GetURL returns the endpoint closest to the detected region or the fallback, StopPingingEndpoints and Close don't wait for the delay
+// it has no effect without PingInterval, the single check made during construction is never delayed
+func WithInitialProbeDelay(max time.Duration) func(*Latency) {
+	return func(l *Latency) {
+		l.initialProbeDelay = max
+	}
+}
+
+// WithEWMA selects the fastest endpoint on an exponential moving average of its latency, alpha*latest + (1-alpha)*average
+// a short spike barely moves the average while a lasting shift does, an alpha of 1 selects on the latest probe like the default
+// failed probes are not averaged, they fail the endpoint right away, it replaces WithSampleWindow
+// alpha has to be greater than 0 and at most 1, otherwise the constructor returns ErrInvalidAlpha
+func WithEWMA(alpha float64) func(*Latency) {
+	return func(l *Latency) {
+		l.ewma = true
+		l.ewmaAlpha = alpha
+	}
+}
+
+// WithStaleAfter bounds how old a selection may get, once the last completed latency check is older than d GetURL returns universal or the fallback
+// e.g when the process was suspended and the periodic checks fell behind, the next completed check restores latency routing
+// it only applies once a check completed, before that GetURL returns the endpoint closest to the detected region as usual
+func WithStaleAfter(d time.Duration) func(*Latency) {
+	return func(l *Latency) {
+		l.staleAfter = d
+	}
+}
+
+// WithKeepProbeConnectionsWarm decides whether the internal probe transport reuses its connections from one check to the next
+// warm connections measure the steady state round trip time, only the first probe of an endpoint pays the TCP and TLS handshakes
+// cold connections dial for every probe, so the handshakes, which a client opening a new connection pays as well, are part of every measurement
+// by default idle connections are reused as long as the transport keeps them, it has no effect on a client that's passed in
+func WithKeepProbeConnectionsWarm(warm bool) func(*Latency) {
+	return func(l *Latency) {
+		l.keepWarm = &warm
+	}
+}
+
+// WithShuffleProbeOrder decides whether the endpoints are probed in a random order every check, it's on by default
+// a fixed order biases the measurements towards the endpoints probed first when probes wait on each other, e.g with WithMaxConcurrentProbes
+func WithShuffleProbeOrder(shuffle bool) func(*Latency) {
+	return func(l *Latency) {
+		l.shuffleProbeOrder = shuffle
+	}
+}
+
+// WithOnProbeError sets a callback called with the error of every failed probe request, e.g to report it to an error tracker
+// it's called for each attempt made with WithProbeRetries, outside of any lock, so it's free to call back into the router
+// the error is the one the probe failed with, e.g ErrBadStatus or the client's *url.Error as is, never the time.Hour latency
+func WithOnProbeError(fn func(url string, err error)) func(*Latency) {
+	return func(l *Latency) {
+		l.onProbeError = fn
+	}
+}
+
+// WithAutoProbeMethod asks every endpoint which methods it allows with an OPTIONS request before its first probe
+// endpoints that allow HEAD are probed with HEAD, the ones that only allow GET with GET, the outcome is kept for later probes
+// when the OPTIONS request fails HEAD is used and it's tried again with the next probe, it replaces WithProbeMethod
+func WithAutoProbeMethod(auto bool) func(*Latency) {
+	return func(l *Latency) {
+		l.autoProbeMethod = auto
+	}
+}
+
+// WithLazyProbe checks the endpoints on demand instead of every PingInterval, e.g for low traffic services
+// GetURL starts a check in the background once the last one is older than ttl and returns the current selection meanwhile
+// concurrent calls share that check, no ping goroutine is started even when PingInterval is set
+// checks stop once the router is closed or the context given to NewLatencyRouterContext is done
+func WithLazyProbe(ttl time.Duration) func(*Latency) {
+	return func(l *Latency) {
+		l.lazyTTL = ttl
+	}
+}
+
+// WithResolver resolves the endpoints' hosts with the resolver instead of the one the application uses, e.g for split horizon DNS
+// it applies to the internal probe client and TCP probes, it's ignored when a client is passed in, that client's dialer decides how hosts are resolved
+func WithResolver(resolver *net.Resolver) func(*Latency) {
+	return func(l *Latency) {
+		l.resolver = resolver
+	}
+}
+
+// WithProbeRequest sends the request returned by fn with every probe instead of a HEAD or GET request, e.g a POST with a small body
+// fn is called for every probe, so each one gets its own body, the request is cloned with the probe's context and only its path and query
+// are used, resolved against the endpoint's URL, e.g a request for /ping probes https://eu.foo.com/ping, success is still decided by the status checks
+// it replaces WithProbeMethod and WithAutoProbeMethod, the headers set with WithProbeHeaders are added to the request's own
+func WithProbeRequest(fn func() *http.Request) func(*Latency) {
+	return func(l *Latency) {
+		l.probeRequest = fn
+	}
+}
@@ -0,0 +1,67 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ProbeOnce sends a single HEAD request to every URL concurrently and returns the round trip times, without a router or goroutine left behind
+// every URL is in the result, the ones that failed or timed out with a duration of time.Hour, like GetLatencies reports them
+// if client is nil the default client is used, the context's error or ErrAllEndpointsFailed when no URL responded is returned along with the result
+func ProbeOnce(ctx context.Context, client *http.Client, urls ...string) (map[string]time.Duration, error) {
+	if len(urls) == 0 {
+		return nil, ErrAtLeastOne
+	}
+	for i, endpoint := range urls {
+		if err := validateEndpoint(fmt.Sprintf("urls[%d]", i), endpoint); err != nil {
+			return nil, err
+		}
+	}
+
+	if client == nil {
+		client = newRouterClient()
+	}
+	l := &Latency{
+		Client:       client,
+		probeMethod:  http.MethodHead,
+		probeRetries: 1,
+		metrics:      noopMetricsCollector{},
+		clock:        realClock{},
+		timeout:      client.Timeout,
+	}
+	if l.timeout <= 0 {
+		l.timeout = defaultClient.Timeout
+	}
+	l.buildProbeClient()
+
+	results := make(chan LatencyResult, len(urls))
+	var wg sync.WaitGroup
+	for _, endpoint := range urls {
+		wg.Add(1)
+		go func(endpoint string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, l.timeout)
+			defer cancel()
+			l.headRequest(ctx, endpoint, results)
+		}(endpoint)
+	}
+	wg.Wait()
+	close(results)
+
+	latencies := make(map[string]time.Duration, len(urls))
+	measured := make([]LatencyResult, 0, len(urls))
+	for result := range results {
+		latencies[result.URL] = result.Duration
+		measured = append(measured, result)
+	}
+	if err := ctx.Err(); err != nil {
+		return latencies, err
+	}
+	if !anySucceeded(measured) {
+		return latencies, ErrAllEndpointsFailed
+	}
+	return latencies, nil
+}
@@ -0,0 +1,49 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestProbeOnce(t *testing.T) {
+	var method string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer up.Close()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	latencies, err := ProbeOnce(context.Background(), nil, up.URL, down.URL)
+	if err != nil {
+		t.Fatalf("ProbeOnce() error %v", err)
+	}
+	if method != http.MethodHead {
+		t.Fatalf("ProbeOnce() sent %s wanted %s", method, http.MethodHead)
+	}
+	if got := latencies[up.URL]; got <= 0 || got >= time.Hour {
+		t.Fatalf("ProbeOnce() got %v for the healthy URL", got)
+	}
+	if got := latencies[down.URL]; got != time.Hour {
+		t.Fatalf("ProbeOnce() got %v for the failed URL wanted %v", got, time.Hour)
+	}
+
+	if latencies, err := ProbeOnce(context.Background(), up.Client(), down.URL); errors.Cause(err) != ErrAllEndpointsFailed || len(latencies) != 1 {
+		t.Fatalf("ProbeOnce() got %v, %v wanted %v with the failed URL", latencies, err, ErrAllEndpointsFailed)
+	}
+	if _, err := ProbeOnce(context.Background(), nil); errors.Cause(err) != ErrAtLeastOne {
+		t.Fatalf("ProbeOnce() got %v wanted %v", err, ErrAtLeastOne)
+	}
+	if _, err := ProbeOnce(context.Background(), nil, "foobar.com"); errors.Cause(err) != ErrMissingProtocol {
+		t.Fatalf("ProbeOnce() got %v wanted %v", err, ErrMissingProtocol)
+	}
+}
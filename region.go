@@ -0,0 +1,381 @@
+package router
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// gcpMetadataURL returns the zone of the instance, e.g projects/123/zones/us-central1-a
+	gcpMetadataURL = "http://metadata.google.internal/computeMetadata/v1/instance/zone"
+	// azureMetadataURL returns the location of the instance, e.g eastus
+	azureMetadataURL = "http://169.254.169.254/metadata/instance/compute/location?api-version=2021-02-01&format=text"
+)
+
+// metadataClient is used when querying cloud metadata servers, they are link local and should answer quickly
+var metadataClient = &http.Client{Timeout: 500 * time.Millisecond}
+
+// RegionDetector determines the region the application is running in
+// the region is used to pick the closest endpoint before any latency checks have run
+type RegionDetector interface {
+	Region() (string, error)
+}
+
+// AWSRegionDetector reads the region from the AWS_REGION environment variable, it's the default detector
+type AWSRegionDetector struct{}
+
+// Region returns the value of AWS_REGION, which is empty when the variable is unset
+func (AWSRegionDetector) Region() (string, error) {
+	return os.Getenv("AWS_REGION"), nil
+}
+
+// StaticRegionDetector reports a region known up front, e.g from config, instead of detecting it
+type StaticRegionDetector string
+
+// Region returns the region as is
+func (d StaticRegionDetector) Region() (string, error) {
+	return string(d), nil
+}
+
+// GCPRegionDetector asks the GCP metadata server for the zone of the instance and derives the region from it
+type GCPRegionDetector struct {
+	// if a client is not set a client with a 500ms timeout will be used
+	Client *http.Client
+	// if URL is not set the standard metadata server address will be used
+	URL string
+}
+
+// Region returns the GCP region, e.g us-central1
+func (d GCPRegionDetector) Region() (string, error) {
+	zone, err := queryMetadata(d.Client, d.URL, gcpMetadataURL, "Metadata-Flavor", "Google")
+	if err != nil {
+		return "", err
+	}
+
+	// projects/123/zones/us-central1-a -> us-central1
+	zone = zone[strings.LastIndex(zone, "/")+1:]
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		return zone[:i], nil
+	}
+	return zone, nil
+}
+
+// AzureRegionDetector asks the Azure instance metadata service for the location of the instance
+type AzureRegionDetector struct {
+	// if a client is not set a client with a 500ms timeout will be used
+	Client *http.Client
+	// if URL is not set the standard instance metadata service address will be used
+	URL string
+}
+
+// Region returns the Azure location, e.g eastus
+func (d AzureRegionDetector) Region() (string, error) {
+	return queryMetadata(d.Client, d.URL, azureMetadataURL, "Metadata", "true")
+}
+
+func queryMetadata(client *http.Client, endpoint, defaultEndpoint, header, value string) (string, error) {
+	if client == nil {
+		client = metadataClient
+	}
+	if len(endpoint) == 0 {
+		endpoint = defaultEndpoint
+	}
+
+	// a client without a timeout would otherwise get a context that is already done
+	ctx := context.Background()
+	if client.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(header, value)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(checkResponseError(err), "could not reach the metadata server")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", errors.Wrap(ErrBadStatus, "metadata server")
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// DefaultRegionMapping resolves a region name to the endpoint that is the closest to it
+// to extend it, copy the entries into a new map and pass that to WithRegionMapping
+var DefaultRegionMapping = map[string]func(EndPoints) string{
+	// AWS
+	"us-east-1":      func(e EndPoints) string { return e.USEast },
+	"us-east-2":      func(e EndPoints) string { return e.USEast },
+	"ca-central-1":   func(e EndPoints) string { return e.USEast },
+	"sa-east-1":      func(e EndPoints) string { return e.USEast },
+	"us-west-1":      func(e EndPoints) string { return e.USWest },
+	"us-west-2":      func(e EndPoints) string { return e.USWest },
+	"ap-south-1":     func(e EndPoints) string { return e.AsiaPacific },
+	"ap-southeast-1": func(e EndPoints) string { return e.AsiaPacific },
+	"ap-southeast-2": func(e EndPoints) string { return e.AsiaPacific },
+	"ap-northeast-1": func(e EndPoints) string { return e.AsiaPacific },
+	"ap-northeast-2": func(e EndPoints) string { return e.AsiaPacific },
+	"eu-central-1":   func(e EndPoints) string { return e.Europe },
+	"eu-west-1":      func(e EndPoints) string { return e.Europe },
+	"eu-west-2":      func(e EndPoints) string { return e.Europe },
+	"eu-west-3":      func(e EndPoints) string { return e.Europe },
+	"eu-north-1":     func(e EndPoints) string { return e.Europe },
+	// GCP
+	"us-east1":        func(e EndPoints) string { return e.USEast },
+	"us-east4":        func(e EndPoints) string { return e.USEast },
+	"us-central1":     func(e EndPoints) string { return e.USEast },
+	"us-west1":        func(e EndPoints) string { return e.USWest },
+	"us-west2":        func(e EndPoints) string { return e.USWest },
+	"europe-west1":    func(e EndPoints) string { return e.Europe },
+	"europe-west3":    func(e EndPoints) string { return e.Europe },
+	"asia-south1":     func(e EndPoints) string { return e.AsiaPacific },
+	"asia-southeast1": func(e EndPoints) string { return e.AsiaPacific },
+	// Azure
+	"eastus":        func(e EndPoints) string { return e.USEast },
+	"eastus2":       func(e EndPoints) string { return e.USEast },
+	"westus":        func(e EndPoints) string { return e.USWest },
+	"westus2":       func(e EndPoints) string { return e.USWest },
+	"westeurope":    func(e EndPoints) string { return e.Europe },
+	"northeurope":   func(e EndPoints) string { return e.Europe },
+	"southeastasia": func(e EndPoints) string { return e.AsiaPacific },
+	"centralindia":  func(e EndPoints) string { return e.AsiaPacific },
+}
+
+// earthRadiusKm is the mean radius of the earth used for great-circle distances
+const earthRadiusKm = 6371.0
+
+// regionCoordinates are the approximate latitude and longitude of the data centers behind each regional field
+var regionCoordinates = map[string][2]float64{
+	"us-east": {38.9, -77.4},
+	"us-west": {45.8, -119.7},
+	"eu":      {53.3, -6.3},
+	"apac":    {1.3, 103.8},
+}
+
+// nearestEndpoint returns the regional endpoint with the shortest great-circle distance to the coordinates
+// custom regions have no known location and are not considered, an empty string is returned if no regional field is set
+func nearestEndpoint(latitude, longitude float64, endpoints EndPoints) string {
+	regions := []struct {
+		label    string
+		endpoint string
+	}{
+		{"us-east", endpoints.USEast},
+		{"us-west", endpoints.USWest},
+		{"eu", endpoints.Europe},
+		{"apac", endpoints.AsiaPacific},
+	}
+
+	var nearest string
+	shortest := math.Inf(1)
+	for _, region := range regions {
+		if len(region.endpoint) == 0 {
+			continue
+		}
+		location := regionCoordinates[region.label]
+		if d := greatCircleDistance(latitude, longitude, location[0], location[1]); d < shortest {
+			shortest = d
+			nearest = region.endpoint
+		}
+	}
+	return nearest
+}
+
+// greatCircleDistance returns the distance in kilometers between two points using the haversine formula
+func greatCircleDistance(lat1, lon1, lat2, lon2 float64) float64 {
+	toRadians := func(degrees float64) float64 {
+		return degrees * math.Pi / 180
+	}
+
+	dLat := toRadians(lat2 - lat1)
+	dLon := toRadians(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// closestEndpoint returns the endpoint that best matches the region, or an empty string if there is none
+func closestEndpoint(region string, endpoints EndPoints, mapping map[string]func(EndPoints) string) string {
+	// custom regions are more specific than the built in fields, so they take precedence
+	if endpoint, ok := endpoints.CustomRegions[region]; ok && len(endpoint) > 0 {
+		return endpoint
+	}
+
+	if resolve, ok := mapping[region]; ok && resolve != nil {
+		return resolve(endpoints)
+	}
+	return ""
+}
+
+// regionLabel returns the logical region the URL is configured under, e.g us-east or eu, custom regions use their region name
+// regional fields are preferred over universal and fallback, which are allowed to share a URL with a region
+func (e EndPoints) regionLabel(url string) string {
+	_, region := e.configuredAs(url)
+	return region
+}
+
+// configuredAs returns the json name and logical region of the most specific field the URL is configured under
+// the zones of a region are reported as the region's field
+func (e EndPoints) configuredAs(url string) (field, region string) {
+	if len(url) == 0 {
+		return "", ""
+	}
+
+	switch {
+	case url == e.USEast || containsString(e.USEastZones, url):
+		return "us_east", "us-east"
+	case url == e.USWest || containsString(e.USWestZones, url):
+		return "us_west", "us-west"
+	case url == e.Europe || containsString(e.EuropeZones, url):
+		return "europe", "eu"
+	case url == e.AsiaPacific || containsString(e.AsiaPacificZones, url):
+		return "asia_pacific", "apac"
+	}
+
+	for _, region := range e.customRegionNames() {
+		if url == e.CustomRegions[region] || containsString(e.CustomRegionZones[region], url) {
+			return region, region
+		}
+	}
+
+	switch {
+	case url == e.Universal:
+		return "universal", "universal"
+	case url == e.Fallback:
+		return "fallback", "fallback"
+	case containsString(e.Fallbacks, url):
+		return "fallbacks", "fallback"
+	}
+	return "", ""
+}
+
+// All returns every configured URL once, in field order followed by the custom regions sorted by region and the fallbacks
+// the zones of a region follow its field, FastestURL is left out as it's always one of the regions
+func (e EndPoints) All() []string {
+	var all []string
+	seen := make(map[string]bool)
+	for _, endpoint := range e.namedEndpoints() {
+		if endpoint.name == "FastestURL" || len(endpoint.url) == 0 || seen[endpoint.url] {
+			continue
+		}
+		seen[endpoint.url] = true
+		all = append(all, endpoint.url)
+	}
+	return all
+}
+
+// AllWithRegions returns the configured fields keyed by their logical region, e.g us-east, eu, apac, universal or fallback
+// custom regions are keyed by their region name and Fallbacks by fallbacks, comma separated, the zones of a region are left out, see All
+func (e EndPoints) AllWithRegions() map[string]string {
+	regions := map[string]string{
+		"us-east":   e.USEast,
+		"us-west":   e.USWest,
+		"eu":        e.Europe,
+		"apac":      e.AsiaPacific,
+		"universal": e.Universal,
+		"fallback":  e.Fallback,
+		"fallbacks": strings.Join(e.Fallbacks, ","),
+	}
+	for region, endpoint := range e.CustomRegions {
+		regions[region] = endpoint
+	}
+
+	for region, endpoint := range regions {
+		if len(endpoint) == 0 {
+			delete(regions, region)
+		}
+	}
+	return regions
+}
+
+// ResolvedRegion returns the region reported by the region detector, AWS_REGION by default, lower cased
+func (l *Latency) ResolvedRegion() string {
+	return l.AWSRegion
+}
+
+// ClosestRegionName returns the logical region of the URL GetURL currently returns, e.g us-east, eu or universal
+// custom regions are reported by their region name, an empty string is returned if the URL is not configured anywhere
+func (l *Latency) ClosestRegionName() string {
+	url := l.GetURL()
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.EndPoints.regionLabel(url)
+}
+
+// GetURLWithRegion returns the URL GetURL returns along with the EndPoints field it's configured under, by its json name, e.g us_east
+// regional fields are preferred over custom regions, which are reported by their region name, then universal, fallback and fallbacks
+// the region is empty when the URL is not configured anywhere, e.g an override
+func (l *Latency) GetURLWithRegion() (url, region string) {
+	url = l.GetURL()
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return url, l.EndPoints.fieldName(url)
+}
+
+// fieldName returns the json name of the most specific field the URL is configured under
+func (e EndPoints) fieldName(url string) string {
+	field, _ := e.configuredAs(url)
+	return field
+}
+
+// forcedRegionKey is the context key of the region set with WithForcedRegion
+type forcedRegionKey struct{}
+
+// WithForcedRegion returns a copy of the context which pins GetURLFromContext to the region, e.g for data residency
+// the region is either a logical region, us-east, us-west, eu or apac, a custom region name, or a region known to the region mapping, e.g eu-west-1
+func WithForcedRegion(ctx context.Context, region string) context.Context {
+	return context.WithValue(ctx, forcedRegionKey{}, strings.ToLower(region))
+}
+
+// GetURLFromContext returns the first endpoint of the region forced with WithForcedRegion, even over an override
+// it behaves like GetURL when no region was forced or the forced region has no endpoint configured
+func (l *Latency) GetURLFromContext(ctx context.Context) string {
+	region, _ := ctx.Value(forcedRegionKey{}).(string)
+	if len(region) == 0 {
+		return l.GetURL()
+	}
+
+	l.mu.RLock()
+	endpoint := l.EndPoints.regionEndpoint(region, l.regionMapping)
+	l.mu.RUnlock()
+	if len(endpoint) == 0 {
+		l.logf("the forced region %s has no endpoint configured", region)
+		return l.GetURL()
+	}
+	return endpoint
+}
+
+// regionEndpoint returns the endpoint of the logical region, custom region or mapped region, or an empty string if there is none
+func (e EndPoints) regionEndpoint(region string, mapping map[string]func(EndPoints) string) string {
+	switch region {
+	case "us-east":
+		return e.USEast
+	case "us-west":
+		return e.USWest
+	case "eu":
+		return e.Europe
+	case "apac":
+		return e.AsiaPacific
+	}
+	return closestEndpoint(region, e, mapping)
+}
@@ -0,0 +1,409 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestRegionDetectors(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("Metadata-Flavor") == "Google":
+			w.Write([]byte("projects/123456/zones/europe-west1-b"))
+		case r.Header.Get("Metadata") == "true":
+			w.Write([]byte("westus2\n"))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer s.Close()
+
+	tests := []struct {
+		name     string
+		detector RegionDetector
+		want     string
+	}{
+		{
+			name:     "should derive the region from the gcp zone",
+			detector: GCPRegionDetector{URL: s.URL},
+			want:     "europe-west1",
+		},
+		{
+			name:     "should return the azure location",
+			detector: AzureRegionDetector{URL: s.URL},
+			want:     "westus2",
+		},
+		{
+			name:     "should not time out with a client without a timeout",
+			detector: AzureRegionDetector{Client: &http.Client{}, URL: s.URL},
+			want:     "westus2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.detector.Region()
+			if err != nil {
+				t.Fatalf("Region() unexpected error %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("Region() got %s wanted %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithRegionDetector(t *testing.T) {
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USWest:   "http://foobar.com?region=us-west",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	tests := []struct {
+		name   string
+		region string
+		want   string
+	}{
+		{
+			name:   "should pick eu for a gcp region",
+			region: "europe-west1",
+			want:   endpoints.Europe,
+		},
+		{
+			name:   "should pick us-west for an azure region",
+			region: "westus2",
+			want:   endpoints.USWest,
+		},
+		{
+			name:   "should pick eu for eu-west-1",
+			region: "eu-west-1",
+			want:   endpoints.Europe,
+		},
+		{
+			name:   "should use the fallback for an unknown region",
+			region: "mars-north1",
+			want:   endpoints.Fallback,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewLatencyRouter(endpoints, WithRegionDetector(StaticRegionDetector(tt.region)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := l.GetURL(); got != tt.want {
+				t.Fatalf("Latency.GetURL() got %s wanted %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithRegionMapping(t *testing.T) {
+	endpoints := EndPoints{
+		AsiaPacific: "http://foobar.com?region=apac",
+		Europe:      "http://foobar.com?region=eu",
+		Fallback:    "http://foobar.com?region=fallback",
+	}
+
+	l, _ := NewLatencyRouter(endpoints, WithRegionDetector(StaticRegionDetector("ap-southeast-1")))
+	if got := l.GetURL(); got != endpoints.AsiaPacific {
+		t.Fatalf("Latency.GetURL() got %s wanted %s", got, endpoints.AsiaPacific)
+	}
+
+	mapping := make(map[string]func(EndPoints) string, len(DefaultRegionMapping)+1)
+	for region, resolve := range DefaultRegionMapping {
+		mapping[region] = resolve
+	}
+	mapping["me-south-1"] = func(e EndPoints) string { return e.Europe }
+
+	l, _ = NewLatencyRouter(endpoints, WithRegionDetector(StaticRegionDetector("me-south-1")), WithRegionMapping(mapping))
+	if got := l.GetURL(); got != endpoints.Europe {
+		t.Fatalf("Latency.GetURL() got %s wanted %s", got, endpoints.Europe)
+	}
+}
+
+func TestLatency_ClosestRegionName(t *testing.T) {
+	endpoints := EndPoints{
+		Europe:        "http://foobar.com?region=eu",
+		USEast:        "http://foobar.com?region=us-east",
+		Fallback:      "http://foobar.com?region=us-east",
+		CustomRegions: map[string]string{"sa-east-1": "http://foobar.com?region=sa-east"},
+	}
+
+	tests := []struct {
+		name       string
+		region     string
+		wantRegion string
+		wantLabel  string
+	}{
+		{
+			name:       "should prefer the region over a fallback sharing its URL",
+			region:     "US-EAST-2",
+			wantRegion: "us-east-2",
+			wantLabel:  "us-east",
+		},
+		{
+			name:       "should report eu",
+			region:     "eu-central-1",
+			wantRegion: "eu-central-1",
+			wantLabel:  "eu",
+		},
+		{
+			name:       "should report a custom region by its name",
+			region:     "sa-east-1",
+			wantRegion: "sa-east-1",
+			wantLabel:  "sa-east-1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _ := NewLatencyRouter(endpoints, WithRegionDetector(StaticRegionDetector(tt.region)))
+			if got := l.ResolvedRegion(); got != tt.wantRegion {
+				t.Fatalf("Latency.ResolvedRegion() got %s wanted %s", got, tt.wantRegion)
+			}
+			if got := l.ClosestRegionName(); got != tt.wantLabel {
+				t.Fatalf("Latency.ClosestRegionName() got %s wanted %s", got, tt.wantLabel)
+			}
+		})
+	}
+}
+
+func TestWithClientCoordinates(t *testing.T) {
+	endpoints := EndPoints{
+		AsiaPacific: "http://foobar.com?region=apac",
+		Europe:      "http://foobar.com?region=eu",
+		USWest:      "http://foobar.com?region=us-west",
+		Universal:   "http://foobar.com?region=universal",
+		Fallback:    "http://foobar.com?region=fallback",
+	}
+
+	tests := []struct {
+		name    string
+		options []func(*Latency)
+		want    string
+	}{
+		{
+			name:    "should keep returning universal without coordinates",
+			options: []func(*Latency){WithRegionDetector(StaticRegionDetector(""))},
+			want:    endpoints.Universal,
+		},
+		{
+			name:    "should pick eu for paris",
+			options: []func(*Latency){WithRegionDetector(StaticRegionDetector("")), WithClientCoordinates(48.9, 2.4)},
+			want:    endpoints.Europe,
+		},
+		{
+			name:    "should pick apac for tokyo",
+			options: []func(*Latency){WithRegionDetector(StaticRegionDetector("")), WithClientCoordinates(35.7, 139.7)},
+			want:    endpoints.AsiaPacific,
+		},
+		{
+			name:    "should pick the nearest configured region for new york",
+			options: []func(*Latency){WithRegionDetector(StaticRegionDetector("")), WithClientCoordinates(40.7, -74.0)},
+			want:    endpoints.USWest,
+		},
+		{
+			name:    "should prefer the detected region",
+			options: []func(*Latency){WithRegionDetector(StaticRegionDetector("eu-west-1")), WithClientCoordinates(35.7, 139.7)},
+			want:    endpoints.Europe,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _ := NewLatencyRouter(endpoints, tt.options...)
+			if got := l.GetURL(); got != tt.want {
+				t.Fatalf("Latency.GetURL() got %s wanted %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLatency_GetURLWithRegion(t *testing.T) {
+	endpoints := EndPoints{
+		Europe:        "http://foobar.com?region=eu",
+		USEast:        "http://foobar.com?region=us-east",
+		Universal:     "http://foobar.com?region=us-east",
+		Fallback:      "http://foobar.com?region=fallback",
+		CustomRegions: map[string]string{"sa-east-1": "http://foobar.com?region=sa-east"},
+	}
+
+	tests := []struct {
+		name       string
+		region     string
+		override   string
+		wantURL    string
+		wantRegion string
+	}{
+		{
+			name:       "should prefer the region over universal sharing its URL",
+			wantURL:    endpoints.Universal,
+			wantRegion: "us_east",
+		},
+		{
+			name:       "should report the json name of the field",
+			region:     "eu-west-1",
+			wantURL:    endpoints.Europe,
+			wantRegion: "europe",
+		},
+		{
+			name:       "should report a custom region by its name",
+			region:     "sa-east-1",
+			wantURL:    endpoints.CustomRegions["sa-east-1"],
+			wantRegion: "sa-east-1",
+		},
+		{
+			name:     "should report no region for an override",
+			override: "http://override.foobar.com",
+			wantURL:  "http://override.foobar.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _ := NewLatencyRouter(endpoints, WithRegionDetector(StaticRegionDetector(tt.region)))
+			if len(tt.override) > 0 {
+				l.SetOverride(tt.override)
+			}
+			url, region := l.GetURLWithRegion()
+			if url != tt.wantURL || region != tt.wantRegion {
+				t.Fatalf("Latency.GetURLWithRegion() got %s, %s wanted %s, %s", url, region, tt.wantURL, tt.wantRegion)
+			}
+		})
+	}
+}
+
+func TestLatency_GetURLFromContext(t *testing.T) {
+	endpoints := EndPoints{
+		Europe:        "http://foobar.com?region=eu",
+		USEast:        "http://foobar.com?region=us-east",
+		Fallback:      "http://foobar.com?region=fallback",
+		CustomRegions: map[string]string{"sa-east-1": "http://foobar.com?region=sa-east"},
+	}
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		override string
+		want     string
+	}{
+		{
+			name: "should route normally without a forced region",
+			ctx:  context.Background(),
+			want: endpoints.USEast,
+		},
+		{
+			name: "should honor a forced logical region",
+			ctx:  WithForcedRegion(context.Background(), "EU"),
+			want: endpoints.Europe,
+		},
+		{
+			name: "should resolve a forced region through the region mapping",
+			ctx:  WithForcedRegion(context.Background(), "eu-west-1"),
+			want: endpoints.Europe,
+		},
+		{
+			name: "should honor a forced custom region",
+			ctx:  WithForcedRegion(context.Background(), "sa-east-1"),
+			want: endpoints.CustomRegions["sa-east-1"],
+		},
+		{
+			name:     "should prefer a forced region over an override",
+			ctx:      WithForcedRegion(context.Background(), "eu"),
+			override: "http://override.foobar.com",
+			want:     endpoints.Europe,
+		},
+		{
+			name: "should fall through for an unconfigured region",
+			ctx:  WithForcedRegion(context.Background(), "apac"),
+			want: endpoints.USEast,
+		},
+		{
+			name: "should fall through for an unknown region",
+			ctx:  WithForcedRegion(context.Background(), "mars-north-1"),
+			want: endpoints.USEast,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _ := NewLatencyRouter(endpoints, WithRegionDetector(StaticRegionDetector("us-east-1")))
+			if len(tt.override) > 0 {
+				l.SetOverride(tt.override)
+			}
+			if got := l.GetURLFromContext(tt.ctx); got != tt.want {
+				t.Fatalf("Latency.GetURLFromContext() got %s wanted %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRegionRouter(t *testing.T) {
+	os.Setenv("AWS_REGION", "us-east-1")
+	defer os.Setenv("AWS_REGION", "")
+	endpoints := EndPoints{
+		Europe:        "http://foobar.com?region=eu",
+		USEast:        "http://foobar.com?region=us-east",
+		Fallback:      "http://foobar.com?region=fallback",
+		CustomRegions: map[string]string{"sa-east-1": "http://foobar.com?region=sa-east"},
+	}
+
+	tests := []struct {
+		name   string
+		region string
+		want   string
+	}{
+		{name: "should ignore AWS_REGION", region: "eu-west-1", want: endpoints.Europe},
+		{name: "should resolve a custom region", region: "SA-EAST-1", want: endpoints.CustomRegions["sa-east-1"]},
+		{name: "should fall back without a region", want: endpoints.Fallback},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewRegionRouter(endpoints, tt.region, WithRegionDetector(AWSRegionDetector{}))
+			if err != nil {
+				t.Fatalf("NewRegionRouter() error %v", err)
+			}
+			if got := l.GetURL(); got != tt.want {
+				t.Fatalf("Latency.GetURL() got %s wanted %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEndPoints_All(t *testing.T) {
+	endpoints := EndPoints{
+		Europe:        "http://foobar.com?region=eu",
+		USEast:        "http://foobar.com?region=us-east-1a",
+		USEastZones:   []string{"http://foobar.com?region=us-east-1b"},
+		Universal:     "http://foobar.com?region=eu",
+		Fallback:      "http://foobar.com?region=fallback",
+		FastestURL:    "http://foobar.com?region=eu",
+		CustomRegions: map[string]string{"sa-east-1": "http://foobar.com?region=sa-east"},
+		Fallbacks:     []string{"http://foobar.com?region=fallback-2"},
+	}
+
+	want := []string{
+		"http://foobar.com?region=eu",
+		"http://foobar.com?region=us-east-1a",
+		"http://foobar.com?region=us-east-1b",
+		"http://foobar.com?region=fallback",
+		"http://foobar.com?region=sa-east",
+		"http://foobar.com?region=fallback-2",
+	}
+	if got := endpoints.All(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("EndPoints.All() got %v wanted %v", got, want)
+	}
+
+	wantRegions := map[string]string{
+		"eu":        endpoints.Europe,
+		"us-east":   endpoints.USEast,
+		"universal": endpoints.Universal,
+		"fallback":  endpoints.Fallback,
+		"sa-east-1": endpoints.CustomRegions["sa-east-1"],
+		"fallbacks": "http://foobar.com?region=fallback-2",
+	}
+	if got := endpoints.AllWithRegions(); !reflect.DeepEqual(got, wantRegions) {
+		t.Fatalf("EndPoints.AllWithRegions() got %v wanted %v", got, wantRegions)
+	}
+}
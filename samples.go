@@ -0,0 +1,55 @@
+package router
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// sampleWindow is a fixed size ring buffer of the most recent probe durations for a single endpoint
+type sampleWindow struct {
+	durations []time.Duration
+	next      int
+}
+
+func newSampleWindow(size int) *sampleWindow {
+	return &sampleWindow{durations: make([]time.Duration, 0, size)}
+}
+
+// add stores the duration, overwriting the oldest sample once the window is full
+func (w *sampleWindow) add(d time.Duration) {
+	if len(w.durations) < cap(w.durations) {
+		w.durations = append(w.durations, d)
+		return
+	}
+	w.durations[w.next] = d
+	w.next = (w.next + 1) % len(w.durations)
+}
+
+// mean returns the average of the samples that are available
+func (w *sampleWindow) mean() time.Duration {
+	if len(w.durations) == 0 {
+		return time.Hour
+	}
+
+	var total time.Duration
+	for _, d := range w.durations {
+		total += d
+	}
+	return total / time.Duration(len(w.durations))
+}
+
+// percentile returns the nearest rank percentile of the samples that are available, e.g p90 for 90
+func (w *sampleWindow) percentile(p float64) time.Duration {
+	if len(w.durations) == 0 {
+		return time.Hour
+	}
+
+	sorted := append([]time.Duration(nil), w.durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
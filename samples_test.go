@@ -0,0 +1,220 @@
+package router
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestSampleWindow_mean(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		samples []time.Duration
+		want    time.Duration
+	}{
+		{
+			name: "should be time.Hour without samples",
+			size: 3,
+			want: time.Hour,
+		},
+		{
+			name:    "should average what is available when the window is not full",
+			size:    3,
+			samples: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond},
+			want:    15 * time.Millisecond,
+		},
+		{
+			name:    "should drop the oldest sample once the window is full",
+			size:    2,
+			samples: []time.Duration{time.Hour, 10 * time.Millisecond, 30 * time.Millisecond},
+			want:    20 * time.Millisecond,
+		},
+		{
+			name:    "should only use the last sample with a window of one",
+			size:    1,
+			samples: []time.Duration{10 * time.Millisecond, 30 * time.Millisecond},
+			want:    30 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newSampleWindow(tt.size)
+			for _, d := range tt.samples {
+				w.add(d)
+			}
+			if got := w.mean(); got != tt.want {
+				t.Fatalf("sampleWindow.mean() got %v wanted %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSampleWindow_percentile(t *testing.T) {
+	w := newSampleWindow(10)
+	if got := w.percentile(90); got != time.Hour {
+		t.Fatalf("sampleWindow.percentile() got %v wanted time.Hour without samples", got)
+	}
+
+	for i := 10; i >= 1; i-- {
+		w.add(time.Duration(i) * time.Millisecond)
+	}
+	tests := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{p: 50, want: 5 * time.Millisecond},
+		{p: 90, want: 9 * time.Millisecond},
+		{p: 95, want: 10 * time.Millisecond},
+		{p: 100, want: 10 * time.Millisecond},
+		{p: 1, want: time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := w.percentile(tt.p); got != tt.want {
+			t.Fatalf("sampleWindow.percentile(%v) got %v wanted %v", tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestWithSampleWindow_failedProbe(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	var failing int32
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		if atomic.LoadInt32(&failing) == 1 {
+			return 0, ErrTimeout
+		}
+		return 10 * time.Millisecond, nil
+	})
+	var allFailed int32
+	l, _ := NewLatencyRouter(endpoints, probe, WithSampleWindow(3), WithOnAllFailed(func() {
+		atomic.AddInt32(&allFailed, 1)
+	}))
+	l.findLowLatencyEndpoint(context.Background())
+	l.findLowLatencyEndpoint(context.Background())
+
+	// the window still averages below time.Hour, but the latest probe of every endpoint failed
+	atomic.StoreInt32(&failing, 1)
+	if err := l.RefreshNow(context.Background()); err != ErrAllEndpointsFailed {
+		t.Fatalf("Latency.RefreshNow() got %v wanted %v", err, ErrAllEndpointsFailed)
+	}
+	if got := atomic.LoadInt32(&allFailed); got != 1 {
+		t.Fatalf("WithOnAllFailed() called %d times wanted once", got)
+	}
+}
+
+func TestWithSelectionPercentile(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	// europe is faster on average but has a slow tail, us-east is steady
+	var checks int32
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		if url != endpoints.Europe {
+			return 20 * time.Millisecond, nil
+		}
+		if atomic.AddInt32(&checks, 1)%5 == 0 {
+			return 50 * time.Millisecond, nil
+		}
+		return 5 * time.Millisecond, nil
+	})
+
+	tests := []struct {
+		name    string
+		options []func(*Latency)
+		want    string
+	}{
+		{name: "should select on the mean by default", want: endpoints.Europe},
+		{name: "should select on the tail", options: []func(*Latency){WithSelectionPercentile(90)}, want: endpoints.USEast},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&checks, 0)
+			l, _ := NewLatencyRouter(endpoints, append(tt.options, probe, WithSampleWindow(10))...)
+			for i := 0; i < 10; i++ {
+				l.findLowLatencyEndpoint(context.Background())
+			}
+			if got := l.GetURL(); got != tt.want {
+				t.Fatalf("Latency.GetURL() got %s wanted %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithEWMA(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	var europe int64
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		if url == endpoints.Europe {
+			return time.Duration(atomic.LoadInt64(&europe)), nil
+		}
+		return 20 * time.Millisecond, nil
+	})
+
+	tests := []struct {
+		name   string
+		alpha  float64
+		europe []time.Duration
+		// want is the selected endpoint after each europe latency
+		want []string
+	}{
+		{
+			name:   "should ride out a single spike",
+			alpha:  0.1,
+			europe: []time.Duration{10 * time.Millisecond, 100 * time.Millisecond, 10 * time.Millisecond},
+			want:   []string{endpoints.Europe, endpoints.Europe, endpoints.Europe},
+		},
+		{
+			name:   "should follow a lasting shift",
+			alpha:  0.1,
+			europe: []time.Duration{10 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond},
+			want:   []string{endpoints.Europe, endpoints.Europe, endpoints.USEast},
+		},
+		{
+			name:   "should select on the latest probe with an alpha of 1",
+			alpha:  1,
+			europe: []time.Duration{10 * time.Millisecond, 100 * time.Millisecond, 10 * time.Millisecond},
+			want:   []string{endpoints.Europe, endpoints.USEast, endpoints.Europe},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewLatencyRouter(endpoints, probe, WithEWMA(tt.alpha))
+			if err != nil {
+				t.Fatalf("NewLatencyRouter() error %v", err)
+			}
+			for i, latency := range tt.europe {
+				atomic.StoreInt64(&europe, int64(latency))
+				l.findLowLatencyEndpoint(context.Background())
+				if got := l.GetURL(); got != tt.want[i] {
+					t.Fatalf("Latency.GetURL() got %s after check %d wanted %s", got, i+1, tt.want[i])
+				}
+			}
+		})
+	}
+
+	for _, alpha := range []float64{0, -0.5, 1.5} {
+		if _, err := NewLatencyRouter(endpoints, WithEWMA(alpha)); errors.Cause(err) != ErrInvalidAlpha {
+			t.Fatalf("NewLatencyRouter() with alpha %v got %v wanted %v", alpha, err, ErrInvalidAlpha)
+		}
+	}
+}
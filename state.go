@@ -0,0 +1,74 @@
+package router
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// routerState is what ExportState persists and ImportState restores
+type routerState struct {
+	// FastestURL is the URL GetURL returned when the state was exported
+	FastestURL string `json:"fastest_url"`
+	// Latencies is the last measured round trip time per endpoint, failures are stored as time.Hour
+	Latencies map[string]time.Duration `json:"latencies"`
+}
+
+// ExportState returns the fastest URL and the last measured latencies as JSON, e.g to write them to disk before shutting down
+// the result can be handed to ImportState on the next start, so traffic is routed before the first latency check completes
+func (l *Latency) ExportState() ([]byte, error) {
+	l.mu.RLock()
+	state := routerState{
+		FastestURL: l.FastestURL,
+		Latencies:  make(map[string]time.Duration, len(l.latencies)),
+	}
+	for endpoint, duration := range l.latencies {
+		state.Latencies[endpoint] = duration
+	}
+	l.mu.RUnlock()
+
+	return json.Marshal(state)
+}
+
+// ImportState restores a state returned by ExportState, URLs which are no longer configured in EndPoints are dropped
+// it never replaces measurements of a latency check that already completed, the imported state only warms up a router that has not probed yet
+// ErrMalformedConfig is returned when the state can't be decoded
+func (l *Latency) ImportState(data []byte) error {
+	var state routerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return errors.Wrap(ErrMalformedConfig, err.Error())
+	}
+
+	l.mu.Lock()
+	configured := make(map[string]bool)
+	for _, endpoint := range l.EndPoints.namedEndpoints() {
+		if endpoint.name != "FastestURL" {
+			configured[endpoint.url] = true
+		}
+	}
+
+	if l.latencies == nil {
+		l.latencies = make(map[string]time.Duration)
+	}
+	for endpoint, duration := range state.Latencies {
+		if _, measured := l.latencies[endpoint]; configured[endpoint] && !measured {
+			l.latencies[endpoint] = duration
+		}
+	}
+
+	previous := l.FastestURL
+	if l.lastProbe.IsZero() && containsString(l.contenders(), state.FastestURL) {
+		l.FastestURL = state.FastestURL
+	}
+	current := l.FastestURL
+	l.mu.Unlock()
+
+	if previous != current {
+		l.logf("fastest URL restored: %s", current)
+		if l.onChange != nil {
+			l.onChange(previous, current)
+		}
+	}
+	return nil
+}
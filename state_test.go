@@ -0,0 +1,92 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestLatency_ExportImportState(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	endpoints := EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}
+
+	probed, _ := NewLatencyRouter(endpoints, WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		if strings.Contains(url, "eu") {
+			return 5 * time.Millisecond, nil
+		}
+		return 50 * time.Millisecond, nil
+	}))
+	probed.findLowLatencyEndpoint(context.Background())
+
+	data, err := probed.ExportState()
+	if err != nil {
+		t.Fatalf("Latency.ExportState() error %v", err)
+	}
+
+	// an endpoint that was removed from the config since the state was exported
+	var state routerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatalf("Latency.ExportState() wrote invalid json: %v", err)
+	}
+	state.Latencies["http://removed.com"] = time.Millisecond
+	data, _ = json.Marshal(state)
+
+	var changes int
+	restored, _ := NewLatencyRouter(endpoints, WithOnChange(func(_, _ string) { changes++ }))
+	if err := restored.ImportState(data); err != nil {
+		t.Fatalf("Latency.ImportState() error %v", err)
+	}
+
+	if got := restored.GetURL(); got != endpoints.Europe {
+		t.Fatalf("Latency.GetURL() got %s wanted the restored %s", got, endpoints.Europe)
+	}
+	if changes != 1 {
+		t.Fatalf("WithOnChange() called %d times wanted once", changes)
+	}
+	latencies := restored.GetLatencies()
+	if _, ok := latencies["http://removed.com"]; ok {
+		t.Fatalf("Latency.GetLatencies() got %v wanted unknown endpoints to be dropped", latencies)
+	}
+	if latencies[endpoints.Europe] != 5*time.Millisecond || latencies[endpoints.USEast] != 50*time.Millisecond {
+		t.Fatalf("Latency.GetLatencies() got %v wanted the exported latencies", latencies)
+	}
+
+	if err := restored.ImportState([]byte("{")); errors.Cause(err) != ErrMalformedConfig {
+		t.Fatalf("Latency.ImportState() got %v wanted %v", err, ErrMalformedConfig)
+	}
+}
+
+func TestLatency_ImportStateAfterProbe(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	l, _ := NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		if strings.Contains(url, "eu") {
+			return 50 * time.Millisecond, nil
+		}
+		return 5 * time.Millisecond, nil
+	}))
+	l.findLowLatencyEndpoint(context.Background())
+
+	stale := []byte(`{"fastest_url":"http://foobar.com?region=eu","latencies":{"http://foobar.com?region=eu":1000}}`)
+	if err := l.ImportState(stale); err != nil {
+		t.Fatalf("Latency.ImportState() error %v", err)
+	}
+	if got := l.GetURL(); got != l.USEast {
+		t.Fatalf("Latency.GetURL() got %s wanted the measured %s to be kept", got, l.USEast)
+	}
+	if got := l.GetLatencies()[l.Europe]; got != 50*time.Millisecond {
+		t.Fatalf("Latency.GetLatencies() got %v wanted the measured latency to be kept", got)
+	}
+}
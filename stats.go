@@ -0,0 +1,169 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// CheckerStats is a snapshot of everything the latency checker knows, all of it is copied so it's safe to hold on to
+type CheckerStats struct {
+	// FastestURL is the URL currently returned by GetURL
+	FastestURL string `json:"fastest_url"`
+	// Ready is true once GetURL returns an endpoint picked by a completed latency check, see Ready
+	Ready bool `json:"ready"`
+	// LastProbe is when the last latency check completed, it's the zero time if no check has run yet
+	LastProbe time.Time `json:"last_probe"`
+	// Latencies is the last measured round trip time per endpoint, failures are reported as time.Hour
+	Latencies map[string]time.Duration `json:"latencies"`
+	// ConsecutiveFailures is the number of probes in a row that failed per endpoint
+	ConsecutiveFailures map[string]int `json:"consecutive_failures"`
+	// FailureReasons is why the last probe failed per endpoint, e.g timeout or dns, endpoints whose last probe succeeded are absent
+	FailureReasons map[string]FailureReason `json:"failure_reasons"`
+	// BrokenUntil holds the endpoints skipped by WithFailureThreshold and when they become eligible again
+	BrokenUntil map[string]time.Time `json:"broken_until"`
+	// BackoffUntil holds the endpoints that asked not to be probed with a Retry-After header and until when
+	BackoffUntil map[string]time.Time `json:"backoff_until"`
+}
+
+// Stats returns a snapshot of the latency checker's state
+func (l *Latency) Stats() CheckerStats {
+	fastest := l.GetURL()
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	stats := CheckerStats{
+		FastestURL:          fastest,
+		Ready:               l.ready,
+		LastProbe:           l.lastProbe,
+		Latencies:           make(map[string]time.Duration, len(l.latencies)),
+		ConsecutiveFailures: make(map[string]int, len(l.failures)),
+		FailureReasons:      make(map[string]FailureReason, len(l.failureReasons)),
+		BrokenUntil:         make(map[string]time.Time),
+		BackoffUntil:        make(map[string]time.Time),
+	}
+	for endpoint, duration := range l.latencies {
+		stats.Latencies[endpoint] = duration
+	}
+	for endpoint, failures := range l.failures {
+		stats.ConsecutiveFailures[endpoint] = failures
+	}
+	for endpoint, reason := range l.failureReasons {
+		stats.FailureReasons[endpoint] = reason
+	}
+	now := l.clock.Now()
+	for endpoint, until := range l.brokenUntil {
+		if now.Before(until) {
+			stats.BrokenUntil[endpoint] = until
+		}
+	}
+	for endpoint, until := range l.backoffUntil {
+		if now.Before(until) {
+			stats.BackoffUntil[endpoint] = until
+		}
+	}
+	return stats
+}
+
+// LastProbeTime returns when the last latency check completed, it's the zero time if no check has run yet
+// a timestamp that stops advancing while PingInterval is set means the periodic checks are stuck
+func (l *Latency) LastProbeTime() time.Time {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.lastProbe
+}
+
+// routerStatus is the JSON body written by StatusHandler
+type routerStatus struct {
+	// Healthy is true when at least one endpoint passed its last probe
+	Healthy bool `json:"healthy"`
+	// Endpoints reports per endpoint whether its last probe succeeded
+	Endpoints map[string]bool `json:"endpoints"`
+	CheckerStats
+}
+
+// StatusHandler returns a handler reporting the router's health, e.g for a kubernetes readiness probe
+// it responds with 200 when at least one endpoint passed its last probe and 503 otherwise, the body is the Stats snapshot as JSON
+func (l *Latency) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := routerStatus{CheckerStats: l.Stats()}
+		status.Endpoints = make(map[string]bool, len(status.Latencies))
+		for endpoint, latency := range status.Latencies {
+			healthy := latency < time.Hour
+			status.Endpoints[endpoint] = healthy
+			status.Healthy = status.Healthy || healthy
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if status.Healthy {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			l.logf("the status could not be written: %v", err)
+		}
+	})
+}
+
+// Snapshot is a one shot picture of the router, e.g for logs, it's what the router marshals to as JSON
+type Snapshot struct {
+	// SelectedURL is the URL GetURL returned when the snapshot was taken
+	SelectedURL string `json:"selected_url"`
+	// Region is the detected region, it's empty when none was detected
+	Region string `json:"region,omitempty"`
+	// Override is the URL set with SetOverride, it's empty when routing isn't overridden
+	Override string `json:"override,omitempty"`
+	// EndPoints are the configured endpoints, FastestURL is the live selection rather than the configured one
+	EndPoints EndPoints `json:"endpoints"`
+}
+
+// Snapshot returns the selected URL alongside a copy of the configured endpoints
+func (l *Latency) Snapshot() Snapshot {
+	selected := l.GetURL()
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	endpoints := l.EndPoints
+	endpoints.FastestURL = l.FastestURL
+	if l.CustomRegions != nil {
+		endpoints.CustomRegions = make(map[string]string, len(l.CustomRegions))
+		for region, endpoint := range l.CustomRegions {
+			endpoints.CustomRegions[region] = endpoint
+		}
+	}
+	endpoints.Fallbacks = append([]string(nil), l.Fallbacks...)
+	endpoints.AsiaPacificZones = append([]string(nil), l.AsiaPacificZones...)
+	endpoints.EuropeZones = append([]string(nil), l.EuropeZones...)
+	endpoints.USEastZones = append([]string(nil), l.USEastZones...)
+	endpoints.USWestZones = append([]string(nil), l.USWestZones...)
+	if l.CustomRegionZones != nil {
+		endpoints.CustomRegionZones = make(map[string][]string, len(l.CustomRegionZones))
+		for region, zones := range l.CustomRegionZones {
+			endpoints.CustomRegionZones[region] = append([]string(nil), zones...)
+		}
+	}
+	if l.Tags != nil {
+		endpoints.Tags = make(map[string]map[string]string, len(l.Tags))
+		for endpoint, tags := range l.Tags {
+			endpoints.Tags[endpoint] = make(map[string]string, len(tags))
+			for tag, value := range tags {
+				endpoints.Tags[endpoint][tag] = value
+			}
+		}
+	}
+
+	return Snapshot{
+		SelectedURL: selected,
+		Region:      l.AWSRegion,
+		Override:    l.override,
+		EndPoints:   endpoints,
+	}
+}
+
+// MarshalJSON encodes the router as its Snapshot, so logging a router shows the live selection
+func (l *Latency) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.Snapshot())
+}
@@ -0,0 +1,176 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLatency_Stats(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.String(), "eu") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	l, _ := NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, client)
+
+	if stats := l.Stats(); !stats.LastProbe.IsZero() {
+		t.Fatalf("Latency.Stats() got %v wanted a zero LastProbe before any probe", stats.LastProbe)
+	}
+	if got := l.LastProbeTime(); !got.IsZero() {
+		t.Fatalf("Latency.LastProbeTime() got %v wanted the zero time before any probe", got)
+	}
+
+	before := time.Now()
+	l.findLowLatencyEndpoint(context.Background())
+	l.findLowLatencyEndpoint(context.Background())
+	stats := l.Stats()
+
+	if stats.FastestURL != l.USEast {
+		t.Fatalf("Latency.Stats() FastestURL got %s wanted %s", stats.FastestURL, l.USEast)
+	}
+	if stats.LastProbe.Before(before) {
+		t.Fatalf("Latency.Stats() LastProbe got %v wanted after %v", stats.LastProbe, before)
+	}
+	if got := l.LastProbeTime(); !got.Equal(stats.LastProbe) {
+		t.Fatalf("Latency.LastProbeTime() got %v wanted %v", got, stats.LastProbe)
+	}
+	if stats.ConsecutiveFailures[l.Europe] != 2 || stats.ConsecutiveFailures[l.USEast] != 0 {
+		t.Fatalf("Latency.Stats() ConsecutiveFailures got %v", stats.ConsecutiveFailures)
+	}
+	if stats.Latencies[l.Europe] != time.Hour {
+		t.Fatalf("Latency.Stats() Latencies got %v", stats.Latencies)
+	}
+	if _, err := json.Marshal(stats); err != nil {
+		t.Fatalf("CheckerStats should be serializable: %v", err)
+	}
+}
+
+func TestLatency_StatusHandler(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	var down atomic.Value
+	down.Store(false)
+	probe := WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		if down.Load().(bool) || strings.Contains(url, "eu") {
+			return 0, ErrTimeout
+		}
+		return 10 * time.Millisecond, nil
+	})
+
+	l, _ := NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, probe)
+
+	tests := []struct {
+		name        string
+		down        bool
+		wantCode    int
+		wantHealthy map[string]bool
+	}{
+		{
+			name:        "should be ready while an endpoint is healthy",
+			wantCode:    http.StatusOK,
+			wantHealthy: map[string]bool{l.Europe: false, l.USEast: true},
+		},
+		{
+			name:        "should not be ready when every endpoint failed",
+			down:        true,
+			wantCode:    http.StatusServiceUnavailable,
+			wantHealthy: map[string]bool{l.Europe: false, l.USEast: false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			down.Store(tt.down)
+			l.findLowLatencyEndpoint(context.Background())
+
+			w := httptest.NewRecorder()
+			l.StatusHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+			if w.Code != tt.wantCode {
+				t.Fatalf("StatusHandler() got status %d wanted %d", w.Code, tt.wantCode)
+			}
+
+			var body struct {
+				Healthy   bool                     `json:"healthy"`
+				Endpoints map[string]bool          `json:"endpoints"`
+				Latencies map[string]time.Duration `json:"latencies"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatalf("StatusHandler() wrote invalid json: %v", err)
+			}
+			if !reflect.DeepEqual(body.Endpoints, tt.wantHealthy) {
+				t.Fatalf("StatusHandler() endpoints got %v wanted %v", body.Endpoints, tt.wantHealthy)
+			}
+			if len(body.Latencies) != 2 {
+				t.Fatalf("StatusHandler() latencies got %v wanted the Stats latencies", body.Latencies)
+			}
+		})
+	}
+}
+
+func TestLatency_MarshalJSON(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	l, _ := NewLatencyRouter(EndPoints{
+		Europe:   "http://foobar.com?region=eu",
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+		Tags:     map[string]map[string]string{"http://foobar.com?region=eu": {"tier": "premium"}},
+	}, WithProbeFunc(func(_ context.Context, url string) (time.Duration, error) {
+		if strings.Contains(url, "eu") {
+			return 5 * time.Millisecond, nil
+		}
+		return 50 * time.Millisecond, nil
+	}))
+
+	if got := l.Snapshot().SelectedURL; got != l.Fallback {
+		t.Fatalf("Latency.Snapshot() SelectedURL got %s wanted %s before any probe", got, l.Fallback)
+	}
+
+	l.findLowLatencyEndpoint(context.Background())
+	data, err := json.Marshal(l)
+	if err != nil {
+		t.Fatalf("json.Marshal() error %v", err)
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatalf("Latency.MarshalJSON() wrote invalid json: %v", err)
+	}
+	if snapshot.SelectedURL != l.Europe || snapshot.EndPoints.FastestURL != l.Europe {
+		t.Fatalf("Latency.MarshalJSON() got %+v wanted the live selection %s", snapshot, l.Europe)
+	}
+	if snapshot.EndPoints.USEast != l.USEast || snapshot.EndPoints.Tags[l.Europe]["tier"] != "premium" {
+		t.Fatalf("Latency.MarshalJSON() got %+v wanted the configured endpoints", snapshot.EndPoints)
+	}
+
+	// the snapshot is a copy, changing it leaves the router alone
+	copied := l.Snapshot()
+	copied.EndPoints.Tags[l.Europe]["tier"] = "basic"
+	if l.Tags[l.Europe]["tier"] != "premium" {
+		t.Fatalf("Latency.Snapshot() shares its tags with the router")
+	}
+}
@@ -0,0 +1,46 @@
+package router
+
+import "time"
+
+// GetURLForTag returns an endpoint tagged with value under tag, GetURL's endpoint is preferred when it matches
+// otherwise the matching endpoint with the lowest measured latency is returned, or the first one matching when none was measured
+// when no endpoint matches GetURL is returned
+func (l *Latency) GetURLForTag(tag, value string) string {
+	current := l.GetURL()
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.hasTag(current, tag, value) {
+		return current
+	}
+
+	var candidate string
+	fastest := time.Hour
+	for _, endpoint := range l.EndPoints.namedEndpoints() {
+		if endpoint.name == "FastestURL" || !l.hasTag(endpoint.url, tag, value) {
+			continue
+		}
+		if len(candidate) == 0 {
+			candidate = endpoint.url
+		}
+		if latency, ok := l.latencies[endpoint.url]; ok && latency < fastest {
+			fastest = latency
+			candidate = endpoint.url
+		}
+	}
+
+	if len(candidate) == 0 {
+		return current
+	}
+	return candidate
+}
+
+// hasTag reports whether the endpoint is tagged with value under tag
+func (l *Latency) hasTag(endpoint, tag, value string) bool {
+	tags, ok := l.Tags[endpoint]
+	if !ok {
+		return false
+	}
+	got, ok := tags[tag]
+	return ok && got == value
+}
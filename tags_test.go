@@ -0,0 +1,112 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatency_GetURLForTag(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.String(), "eu"):
+			time.Sleep(10 * time.Millisecond)
+		case strings.Contains(r.URL.String(), "apac"):
+			time.Sleep(20 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	endpoints := EndPoints{
+		AsiaPacific: "http://foobar.com?region=apac",
+		Europe:      "http://foobar.com?region=eu",
+		USEast:      "http://foobar.com?region=us-east",
+		Fallback:    "http://foobar.com?region=fallback",
+		Tags: map[string]map[string]string{
+			"http://foobar.com?region=apac":    {"tier": "premium"},
+			"http://foobar.com?region=eu":      {"tier": "premium"},
+			"http://foobar.com?region=us-east": {"tier": "basic"},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		tag   string
+		value string
+		probe bool
+		want  string
+	}{
+		{
+			name:  "should return the current endpoint when it matches",
+			tag:   "tier",
+			value: "basic",
+			probe: true,
+			want:  endpoints.USEast,
+		},
+		{
+			name:  "should return the fastest matching endpoint",
+			tag:   "tier",
+			value: "premium",
+			probe: true,
+			want:  endpoints.Europe,
+		},
+		{
+			name:  "should return the first matching endpoint before any probe",
+			tag:   "tier",
+			value: "premium",
+			want:  endpoints.AsiaPacific,
+		},
+		{
+			name:  "should fall back to GetURL when nothing matches",
+			tag:   "tier",
+			value: "enterprise",
+			probe: true,
+			want:  endpoints.USEast,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _ := NewLatencyRouter(endpoints, client)
+			if tt.probe {
+				l.findLowLatencyEndpoint(context.Background())
+			}
+			if got := l.GetURLForTag(tt.tag, tt.value); got != tt.want {
+				t.Fatalf("Latency.GetURLForTag() got %s wanted %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEndPoints_TagsJSON(t *testing.T) {
+	endpoints := EndPoints{
+		Europe:   "https://eu.foobar.com",
+		Fallback: "https://fallback.foobar.com",
+		Tags:     map[string]map[string]string{"https://eu.foobar.com": {"tier": "premium"}},
+	}
+
+	b, err := json.Marshal(endpoints)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+
+	var got EndPoints
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	if !reflect.DeepEqual(got.Tags, endpoints.Tags) {
+		t.Fatalf("EndPoints.Tags got %v wanted %v", got.Tags, endpoints.Tags)
+	}
+}
@@ -0,0 +1,219 @@
+package router
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxProbeRedirects caps the redirects a probe follows, a health check shouldn't need more than a couple of hops
+const maxProbeRedirects = 5
+
+// buildProbeClient replaces the client with a copy configured by the probe options
+// the copy makes sure the options never leak into a client the user shares with the rest of their application
+func (l *Latency) buildProbeClient() {
+	client := *l.Client
+	// redirects are always decided by the probe options, the user's own policy is meant for their application requests
+	client.CheckRedirect = l.checkRedirect
+	if len(l.endpointTimeouts) > 0 {
+		// each probe is bounded by its own context, a client timeout would cut the slower endpoints short
+		client.Timeout = 0
+	}
+
+	// options that tune the internal transport are ignored when the user supplied their own client
+	internal := l.Client == defaultClient
+	if !internal && l.hasInternalTransportOptions() {
+		l.logf("a custom client was supplied, internal probe transport options are ignored")
+	}
+
+	if len(l.certFingerprint) > 0 || (internal && l.hasInternalTransportOptions()) {
+		transport, ok := cloneTransport(l.Client.Transport)
+		if !ok {
+			l.logf("the client's transport is not an *http.Transport, probe options can not be applied")
+		} else {
+			if internal {
+				l.configureInternalTransport(transport)
+			}
+
+			if len(l.certFingerprint) > 0 {
+				if transport.TLSClientConfig == nil {
+					transport.TLSClientConfig = &tls.Config{}
+				}
+				transport.TLSClientConfig.VerifyPeerCertificate = l.verifyCertFingerprint
+			}
+			client.Transport = transport
+		}
+	}
+	l.Client = &client
+}
+
+// checkRedirect follows up to maxProbeRedirects redirects when WithFollowRedirects is set, otherwise the 3xx response is returned as is
+func (l *Latency) checkRedirect(_ *http.Request, via []*http.Request) error {
+	if !l.followRedirects {
+		return http.ErrUseLastResponse
+	}
+	if len(via) >= maxProbeRedirects {
+		return errors.Errorf("stopped after %d redirects", maxProbeRedirects)
+	}
+	return nil
+}
+
+// hasInternalTransportOptions reports whether any option which only applies to the internally built client is set
+func (l *Latency) hasInternalTransportOptions() bool {
+	return len(l.network) > 0 || l.http2 || l.proxy != nil || l.insecureSkipVerify || l.keepWarm != nil || l.resolver != nil
+}
+
+// configureInternalTransport applies the options that only apply when the default client is used
+func (l *Latency) configureInternalTransport(transport *http.Transport) {
+	if len(l.network) > 0 || l.resolver != nil {
+		dialer := *defaultDialer
+		dialer.Resolver = l.resolver
+		network := l.network
+		transport.DialContext = func(ctx context.Context, n, addr string) (net.Conn, error) {
+			if len(network) > 0 {
+				n = network
+			}
+			return dialer.DialContext(ctx, n, addr)
+		}
+	}
+	if l.proxy != nil {
+		transport.Proxy = l.proxy
+	}
+	if l.insecureSkipVerify {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+	if l.keepWarm != nil {
+		transport.DisableKeepAlives = !*l.keepWarm
+		// an idle connection has to outlive the time between two checks, otherwise every check dials again
+		if *l.keepWarm && transport.IdleConnTimeout > 0 && transport.IdleConnTimeout <= l.PingInterval {
+			transport.IdleConnTimeout = 2 * l.PingInterval
+		}
+	}
+	if l.http2 {
+		// a custom dialer or TLS config disables HTTP/2 unless it's forced, h2 is then offered through ALPN
+		transport.ForceAttemptHTTP2 = true
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+}
+
+// verifyCertFingerprint compares the sha256 fingerprint of the leaf certificate against the expected one
+func (l *Latency) verifyCertFingerprint(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return ErrCertificateMismatch
+	}
+
+	sum := sha256.Sum256(rawCerts[0])
+	if fingerprint := hex.EncodeToString(sum[:]); fingerprint != l.certFingerprint {
+		l.logf("certificate fingerprint %s does not match the expected %s", fingerprint, l.certFingerprint)
+		return errors.Wrap(ErrCertificateMismatch, fingerprint)
+	}
+	return nil
+}
+
+// cloneTransport returns a copy of the round tripper, a nil round tripper is treated as http.DefaultTransport
+func cloneTransport(rt http.RoundTripper) (*http.Transport, bool) {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	transport, ok := rt.(*http.Transport)
+	if !ok {
+		return nil, false
+	}
+	return transport.Clone(), true
+}
+
+// normalizeFingerprint accepts both plain hex and the colon separated form most tools print
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+}
+
+// unixSocketPath returns the socket path of a unix scheme endpoint, e.g /var/run/api.sock for unix:///var/run/api.sock
+func unixSocketPath(endpoint string) (string, bool) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "unix" {
+		return "", false
+	}
+	return u.Path, true
+}
+
+// probeTarget returns the client and URL a probe of the endpoint is sent with
+// unix scheme endpoints get a client dialing their socket, the request itself targets the socket's root
+func (l *Latency) probeTarget(endpoint string) (*http.Client, string) {
+	socket, ok := unixSocketPath(endpoint)
+	if !ok {
+		return l.Client, endpoint
+	}
+
+	client := *l.Client
+	client.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+		// every probe dials the socket again, so the connect time is part of the measurement
+		DisableKeepAlives: true,
+	}
+	return &client, "http://unix/"
+}
+
+// TLSConnectionInfo is what an endpoint negotiated during its last https probe
+type TLSConnectionInfo struct {
+	// Version is the TLS version, e.g TLS 1.3
+	Version string `json:"version"`
+	// CipherSuite is the cipher suite, e.g TLS_AES_128_GCM_SHA256
+	CipherSuite string `json:"cipher_suite"`
+}
+
+// tlsVersions names the TLS versions, tls.VersionName is not available in every supported Go version
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// TLSInfo returns the TLS version and cipher suite the endpoint negotiated during its last probe, it's meant for audits and never affects selection
+// false is returned for http endpoints and endpoints that have not been probed over https yet
+func (l *Latency) TLSInfo(url string) (TLSConnectionInfo, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	info, ok := l.tlsInfo[url]
+	return info, ok
+}
+
+// recordTLSInfo keeps what the endpoint negotiated, it's a no-op for responses that weren't received over TLS
+func (l *Latency) recordTLSInfo(endpoint string, state *tls.ConnectionState) {
+	if state == nil {
+		return
+	}
+
+	version, ok := tlsVersions[state.Version]
+	if !ok {
+		version = fmt.Sprintf("0x%04x", state.Version)
+	}
+	info := TLSConnectionInfo{Version: version, CipherSuite: tls.CipherSuiteName(state.CipherSuite)}
+
+	l.mu.Lock()
+	if l.tlsInfo == nil {
+		l.tlsInfo = make(map[string]TLSConnectionInfo)
+	}
+	l.tlsInfo[endpoint] = info
+	l.mu.Unlock()
+	l.logf("%s negotiated %s with %s", endpoint, info.Version, info.CipherSuite)
+}
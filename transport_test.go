@@ -0,0 +1,478 @@
+package router
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestWithExpectedCertFingerprint(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	sum := sha256.Sum256(s.Certificate().Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name        string
+		fingerprint string
+		wantFailure bool
+	}{
+		{
+			name:        "should succeed when the fingerprint matches",
+			fingerprint: fingerprint,
+		},
+		{
+			name:        "should fail when the fingerprint does not match",
+			fingerprint: "00" + fingerprint[2:],
+			wantFailure: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpClient := s.Client()
+			client := func(l *Latency) {
+				l.Client = httpClient
+			}
+
+			l, _ := NewLatencyRouter(EndPoints{
+				USEast:   s.URL,
+				Fallback: s.URL + "?region=fallback",
+			}, client, WithExpectedCertFingerprint(tt.fingerprint))
+			l.findLowLatencyEndpoint(context.Background())
+
+			if failed := l.GetLatencies()[s.URL] == time.Hour; failed != tt.wantFailure {
+				t.Fatalf("probe failed = %v wanted %v", failed, tt.wantFailure)
+			}
+			if l.Client == httpClient {
+				t.Fatal("the user's client should not be modified")
+			}
+		})
+	}
+}
+
+func TestWithNetworkPreference(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	tests := []struct {
+		name        string
+		network     string
+		wantFailure bool
+	}{
+		{
+			name:    "should reach an ipv4 server over tcp4",
+			network: "tcp4",
+		},
+		{
+			name:        "should not reach an ipv4 server over tcp6",
+			network:     "tcp6",
+			wantFailure: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _ := NewLatencyRouter(EndPoints{
+				USEast:   s.URL,
+				Fallback: s.URL + "?region=fallback",
+			}, WithNetworkPreference(tt.network))
+			l.findLowLatencyEndpoint(context.Background())
+
+			if failed := l.GetLatencies()[s.URL] == time.Hour; failed != tt.wantFailure {
+				t.Fatalf("probe failed = %v wanted %v", failed, tt.wantFailure)
+			}
+			if l.Client == defaultClient {
+				t.Fatal("the default client should not be modified")
+			}
+		})
+	}
+}
+
+func TestWithHTTP2Probing(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	var proto int32
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt32(&proto, int32(r.ProtoMajor))
+		w.WriteHeader(http.StatusOK)
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	// the option only applies to the internal client, which has to trust the test server for this test
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+	original := defaultClient
+	defaultClient = &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		Timeout:   time.Second,
+	}
+	defer func() {
+		defaultClient = original
+	}()
+
+	tests := []struct {
+		name      string
+		options   []func(*Latency)
+		wantProto int32
+	}{
+		{
+			name:      "should probe over HTTP/1.1 by default",
+			wantProto: 1,
+		},
+		{
+			name:      "should probe over HTTP/2",
+			options:   []func(*Latency){WithHTTP2Probing()},
+			wantProto: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _ := NewLatencyRouter(EndPoints{
+				USEast:   s.URL,
+				Fallback: s.URL + "?region=fallback",
+			}, tt.options...)
+			l.findLowLatencyEndpoint(context.Background())
+
+			if got := l.GetLatencies()[s.URL]; got == time.Hour {
+				t.Fatal("probe failed wanted it to succeed")
+			}
+			if got := atomic.LoadInt32(&proto); got != tt.wantProto {
+				t.Fatalf("probe used HTTP/%d wanted HTTP/%d", got, tt.wantProto)
+			}
+		})
+	}
+}
+
+func TestWithProxy(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	var proxied int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a proxy receives the absolute URL of the endpoint
+		if r.URL.Host == "foobar.com" {
+			atomic.AddInt32(&proxied, 1)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	l, _ := NewLatencyRouter(EndPoints{
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, WithProxy(proxyURL))
+	l.findLowLatencyEndpoint(context.Background())
+
+	if got := atomic.LoadInt32(&proxied); got != 1 {
+		t.Fatalf("proxy got %d probes wanted 1", got)
+	}
+	if got := l.GetURL(); got != l.USEast {
+		t.Fatalf("Latency.GetURL() got %s wanted %s", got, l.USEast)
+	}
+
+	l, _ = NewLatencyRouter(EndPoints{
+		USEast:   "http://foobar.com?region=us-east",
+		Fallback: "http://foobar.com?region=fallback",
+	}, WithNoProxy())
+	req, _ := http.NewRequest(http.MethodHead, l.USEast, nil)
+	if got, err := l.Client.Transport.(*http.Transport).Proxy(req); got != nil || err != nil {
+		t.Fatalf("WithNoProxy() got proxy %v, error %v wanted none", got, err)
+	}
+}
+
+func TestWithInsecureSkipVerify(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	tests := []struct {
+		name        string
+		skip        bool
+		wantFailure bool
+	}{
+		{
+			name:        "should reject a self-signed certificate",
+			wantFailure: true,
+		},
+		{
+			name: "should accept a self-signed certificate when skipping verification",
+			skip: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _ := NewLatencyRouter(EndPoints{
+				USEast:   s.URL,
+				Fallback: s.URL + "?region=fallback",
+			}, WithInsecureSkipVerify(tt.skip))
+			l.findLowLatencyEndpoint(context.Background())
+
+			if failed := !l.IsHealthy(s.URL); failed != tt.wantFailure {
+				t.Fatalf("probe failed = %v wanted %v", failed, tt.wantFailure)
+			}
+		})
+	}
+	if defaultClient.Transport.(*http.Transport).TLSClientConfig != nil {
+		t.Fatal("the default client should not be modified")
+	}
+}
+
+func TestWithFollowRedirects(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/signed":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			http.Redirect(w, r, "/signed", http.StatusFound)
+		}
+	})
+
+	httpClient, teardown := testingHTTPClient(h)
+	defer teardown()
+
+	client := func(l *Latency) {
+		l.Client = httpClient
+	}
+
+	endpoints := EndPoints{
+		USEast:   "http://foobar.com/health",
+		Fallback: "http://foobar.com/fallback",
+	}
+
+	tests := []struct {
+		name        string
+		follow      bool
+		wantFailure bool
+	}{
+		{
+			name: "should count the redirect as healthy when not following",
+		},
+		{
+			name:        "should judge the final response when following",
+			follow:      true,
+			wantFailure: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _ := NewLatencyRouter(endpoints, client, WithFollowRedirects(tt.follow))
+			l.findLowLatencyEndpoint(context.Background())
+			if failed := l.GetLatencies()[endpoints.USEast] == time.Hour; failed != tt.wantFailure {
+				t.Fatalf("probe failed = %v wanted %v", failed, tt.wantFailure)
+			}
+			if httpClient.CheckRedirect != nil {
+				t.Fatal("the user's client should not be modified")
+			}
+		})
+	}
+}
+
+func TestUnixSocketEndpoint(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	dir, err := ioutil.TempDir("", "api-router")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "api.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sidecar := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})}
+	go sidecar.Serve(listener)
+	defer sidecar.Close()
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer remote.Close()
+
+	endpoints := EndPoints{
+		USEast:        remote.URL,
+		CustomRegions: map[string]string{"sidecar": "unix://" + socket},
+		Fallback:      remote.URL,
+	}
+
+	tests := []struct {
+		name         string
+		options      []func(*Latency)
+		wantSelected bool
+	}{
+		{name: "should select the faster socket probed over HTTP", wantSelected: true},
+		{name: "should dial the socket with a TCP probe", options: []func(*Latency){WithTCPProbe()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewLatencyRouter(endpoints, tt.options...)
+			if err != nil {
+				t.Fatalf("NewLatencyRouter() error %v", err)
+			}
+			l.findLowLatencyEndpoint(context.Background())
+
+			if !l.IsHealthy(endpoints.CustomRegions["sidecar"]) {
+				t.Fatalf("Latency.GetLatencies() got %v wanted the sidecar to be reachable", l.GetLatencies())
+			}
+			if tt.wantSelected {
+				if got := l.GetURL(); got != endpoints.CustomRegions["sidecar"] {
+					t.Fatalf("Latency.GetURL() got %s wanted the sidecar", got)
+				}
+			}
+		})
+	}
+}
+
+func TestLatency_TLSInfo(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	secure := httptest.NewUnstartedServer(h)
+	secure.TLS = &tls.Config{MinVersion: tls.VersionTLS12, MaxVersion: tls.VersionTLS12}
+	secure.StartTLS()
+	defer secure.Close()
+
+	plain := httptest.NewServer(h)
+	defer plain.Close()
+
+	logger := &recordingLogger{}
+	l, _ := NewLatencyRouter(EndPoints{
+		Europe:   secure.URL,
+		USEast:   plain.URL,
+		Fallback: plain.URL,
+	}, func(l *Latency) {
+		l.Client = secure.Client()
+	}, WithLogger(logger))
+
+	if _, ok := l.TLSInfo(secure.URL); ok {
+		t.Fatalf("Latency.TLSInfo() got info before any probe")
+	}
+	l.findLowLatencyEndpoint(context.Background())
+
+	info, ok := l.TLSInfo(secure.URL)
+	if !ok || info.Version != "TLS 1.2" || len(info.CipherSuite) == 0 {
+		t.Fatalf("Latency.TLSInfo() got %+v, %v wanted TLS 1.2 and a cipher suite", info, ok)
+	}
+	if _, ok := l.TLSInfo(plain.URL); ok {
+		t.Fatalf("Latency.TLSInfo() got info for an http endpoint")
+	}
+	if !logger.contains(secure.URL + " negotiated TLS 1.2 with " + info.CipherSuite) {
+		t.Fatalf("WithLogger() got %v wanted the negotiated version to be logged", logger.lines)
+	}
+}
+
+func TestWithKeepProbeConnectionsWarm(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	var dials int32
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	s.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&dials, 1)
+		}
+	}
+	s.Start()
+	defer s.Close()
+
+	tests := []struct {
+		name      string
+		warm      bool
+		wantDials func(dials int32) bool
+	}{
+		{
+			name: "should reuse connections between checks",
+			warm: true,
+			// both endpoints are probed at the same time, so up to one connection each is dialed
+			wantDials: func(dials int32) bool { return dials <= 2 },
+		},
+		{
+			name:      "should dial for every probe",
+			wantDials: func(dials int32) bool { return dials == 6 },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&dials, 0)
+			l, _ := NewLatencyRouter(EndPoints{
+				Europe:   s.URL + "?region=eu",
+				USEast:   s.URL + "?region=us-east",
+				Fallback: s.URL + "?region=fallback",
+			}, WithKeepProbeConnectionsWarm(tt.warm))
+			defer l.Client.CloseIdleConnections()
+
+			for i := 0; i < 3; i++ {
+				l.findLowLatencyEndpoint(context.Background())
+			}
+			if got := atomic.LoadInt32(&dials); !tt.wantDials(got) {
+				t.Fatalf("WithKeepProbeConnectionsWarm(%v) dialed %d connections for 3 checks", tt.warm, got)
+			}
+		})
+	}
+}
+
+func TestWithResolver(t *testing.T) {
+	os.Setenv("AWS_REGION", "")
+	var lookups int32
+	resolver := &net.Resolver{
+		PreferGo: true,
+		// the internal resolver is unreachable, a lookup that gets here proves it's used
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			atomic.AddInt32(&lookups, 1)
+			return nil, errors.New("internal resolver unavailable")
+		},
+	}
+
+	tests := []struct {
+		name    string
+		options []func(*Latency)
+	}{
+		{name: "should resolve with the internal probe transport", options: []func(*Latency){WithResolver(resolver)}},
+		{name: "should resolve with a TCP probe", options: []func(*Latency){WithResolver(resolver), WithTCPProbe()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&lookups, 0)
+			l, _ := NewLatencyRouter(EndPoints{
+				Europe:   "http://eu.api.internal",
+				USEast:   "http://us-east.api.internal",
+				Fallback: "http://fallback.api.internal",
+			}, tt.options...)
+			l.findLowLatencyEndpoint(context.Background())
+
+			if atomic.LoadInt32(&lookups) == 0 {
+				t.Fatalf("WithResolver() the resolver was never used")
+			}
+			if reason := l.Stats().FailureReasons[l.Europe]; reason != FailureDNS {
+				t.Fatalf("Latency.Stats() FailureReasons got %q wanted %q", reason, FailureDNS)
+			}
+		})
+	}
+}